@@ -2,6 +2,7 @@ package auth
 
 import (
 	"bufio"
+	"fmt"
 	"github.com/spance/deblocus/exception"
 	"os"
 	"strings"
@@ -62,6 +63,37 @@ func NewFileAuthSys(path string) (AuthSys, error) {
 	return sys, nil
 }
 
+// report every invalid line of the auth file without stopping
+func CheckFileAuthSys(path string, report func(line int, e error)) {
+	f, e := os.Open(path)
+	if e != nil {
+		report(0, INVALID_AUTH_CONF.Apply(e))
+		return
+	}
+	defer f.Close()
+	var (
+		r     = bufio.NewScanner(f)
+		users = make(map[string]int)
+	)
+	for n := 1; r.Scan(); n++ {
+		line := r.Text()
+		if len(line) > 0 {
+			arr := strings.SplitN(line, ":", 2)
+			switch {
+			case len(arr) < 2 || arr[0] == "":
+				report(n, INVALID_AUTH_CONF.Apply("expected user:pass"))
+			case users[arr[0]] > 0:
+				report(n, INVALID_AUTH_CONF.Apply(fmt.Sprintf("duplicate user %s of line %d", arr[0], users[arr[0]])))
+			default:
+				users[arr[0]] = n
+			}
+		}
+	}
+	if e = r.Err(); e != nil {
+		report(0, INVALID_AUTH_CONF.Apply(e))
+	}
+}
+
 func (a *FileAuthSys) Authenticate(input []byte) (bool, error) {
 	arr := strings.SplitN(string(input), "\x00", 2)
 	if len(arr) != 2 {
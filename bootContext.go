@@ -6,11 +6,11 @@ import (
 	ex "github.com/spance/deblocus/exception"
 	log "github.com/spance/deblocus/golang/glog"
 	t "github.com/spance/deblocus/tunnel"
-	"math/rand"
 	"net"
 	"os"
 	"runtime"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -19,12 +19,26 @@ type Statser interface {
 	Stats() string
 }
 
+type Drainer interface {
+	Drain()
+}
+
+type Reloader interface {
+	Reload(config string)
+}
+
 type bootContext struct {
 	config    string
 	isServ    bool
 	csc       bool
 	icc       bool
+	toJSON    bool
+	check     bool
+	dump      bool
 	statser   Statser
+	drainer   Drainer
+	reloader  Reloader
+	draining  bool
 	verbosity string
 	debug     bool
 }
@@ -55,6 +69,33 @@ func (c *bootContext) doStats() {
 	}
 }
 
+// drain in background then exit, returns false if unsupported or draining.
+func (c *bootContext) drain() bool {
+	if c.drainer == nil || c.draining {
+		return false
+	}
+	c.draining = true
+	go func() {
+		c.drainer.Drain()
+		sigChan <- t.Bye
+	}()
+	return true
+}
+
+// re-parse the config and apply the changes, keep running if failed.
+func (c *bootContext) reload() {
+	if c.reloader == nil {
+		return
+	}
+	defer func() {
+		if e := recover(); e != nil {
+			log.Errorln("Reload failed,", e)
+		}
+	}()
+	log.Infoln("Reloading", c.config)
+	c.reloader.Reload(c.config)
+}
+
 func (c *bootContext) setLogVerbose(level int) {
 	var vFlag = c.verbosity
 	var v int = -1
@@ -96,25 +137,83 @@ func (c *bootContext) csc_process(output string) {
 	}
 }
 
+func (c *bootContext) convert(output string) {
+	defer func() {
+		if e := recover(); e != nil {
+			fmt.Println(e)
+			os.Exit(1)
+		}
+	}()
+	t.ThrowErr(t.ConvertToJSON(c.config, output, c.isServ))
+}
+
+// print all the problems, returns the exit code
+func (c *bootContext) checkConfig() int {
+	problems := t.CheckConfFile(c.config, c.isServ)
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		fmt.Printf("%s: %d problems were found\n", c.config, len(problems))
+		return 1
+	}
+	fmt.Printf("%s: test is successful\n", c.config)
+	return 0
+}
+
+func (c *bootContext) dumpConfig() {
+	defer func() {
+		if e := recover(); e != nil {
+			fmt.Println(e)
+			os.Exit(1)
+		}
+	}()
+	fmt.Printf("# %s\n# precedence: flag -set > env DEBLOCUS_<FIELD> > file > default\n", c.config)
+	fmt.Print(t.DumpConf(c.config, c.isServ))
+}
+
 type clientMgr struct {
-	dhKeys     *t.DHKeyPair
-	d5pArray   []*t.D5Params
-	clients    []*t.Client
-	num        int
-	indexChain []byte
-}
-
-func (m *clientMgr) selectClient() *t.Client {
-	if m.num > 1 {
-		i := rand.Intn(m.num<<4) >> 4
-		for _, v := range m.indexChain[i : i+m.num-1] {
-			if w := m.clients[v]; w != nil && atomic.LoadInt32(&w.State) >= 0 {
-				return w
+	dhKeys   *t.DHKeyPair
+	clients  []*t.Client
+	strategy t.BalanceStrategy
+	affinity t.Affinity
+	lock     sync.Locker
+}
+
+const (
+	TIER_HEALTHY = iota
+	TIER_DEGRADED
+	TIER_DRAINING
+	TIER_UNHEALTHY
+	TIERS
+)
+
+// the strategy chooses from the best tier of live clients, or the request
+// sticks to the client by hashing its key within the tier.
+func (m *clientMgr) SelectClient(target string, src net.Addr) *t.Client {
+	var tiers [TIERS][]*t.Client
+	for _, w := range m.list() {
+		if w != nil && atomic.LoadInt32(&w.State) >= 0 {
+			var tier int
+			switch {
+			case w.Health() == t.HEALTH_UNHEALTHY:
+				tier = TIER_UNHEALTHY
+			case w.Draining():
+				tier = TIER_DRAINING
+			case w.Health() == t.HEALTH_DEGRADED:
+				tier = TIER_DEGRADED
 			}
+			tiers[tier] = append(tiers[tier], w)
 		}
-	} else {
-		if w := m.clients[0]; w != nil && atomic.LoadInt32(&w.State) >= 0 {
-			return w
+	}
+	for _, available := range tiers {
+		if len(available) > 0 {
+			m.lock.Lock()
+			defer m.lock.Unlock()
+			if key := m.affinity.Key(target, src); key != "" {
+				return t.ChooseByKey(key, available)
+			}
+			return m.strategy.Choose(available)
 		}
 	}
 	log.Errorf("No available tunnels for servicing new request")
@@ -122,17 +221,16 @@ func (m *clientMgr) selectClient() *t.Client {
 	return nil
 }
 
-func (m *clientMgr) selectClientServ(conn net.Conn) {
-	if client := m.selectClient(); client != nil {
-		client.ClientServe(conn)
-	} else {
-		t.SafeClose(conn)
-	}
+func (m *clientMgr) list() []*t.Client {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.clients
 }
 
 func (m *clientMgr) Stats() string {
-	arr := make([]string, m.num)
-	for i, c := range m.clients {
+	clients := m.list()
+	arr := make([]string, len(clients))
+	for i, c := range clients {
 		if c != nil {
 			arr[i] = c.Stats()
 		}
@@ -140,33 +238,113 @@ func (m *clientMgr) Stats() string {
 	return strings.Join(arr, "\n")
 }
 
-func NewClientMgr(d5c *t.D5ClientConf) *clientMgr {
-	d5pArray := d5c.D5PList
-	dhKeys := t.GenerateDHKeyPairs()
-	num := len(d5pArray)
-	var chain []byte
-	if num > 1 {
-		chain = make([]byte, 2*num)
-		for i, _ := range chain {
-			chain[i] = byte(i % num)
-		}
+// keep the clients of the same identity, start the new ones and close the removed.
+func (m *clientMgr) update(d5c *t.D5ClientConf) (started, closed int) {
+	m.lock.Lock()
+	clients, added, removed := t.MatchClients(m.clients, d5c.D5PList, m.dhKeys)
+	m.clients = clients
+	m.strategy, m.affinity = d5c.Balancer, d5c.AffinityBy
+	m.lock.Unlock()
+	for _, c := range added {
+		go c.StartSigTun(false)
 	}
-	mgr := &clientMgr{
-		dhKeys,
-		d5pArray,
-		make([]*t.Client, num),
-		num,
-		chain,
+	for _, c := range removed {
+		c.Close()
 	}
+	return len(added), len(removed)
+}
 
-	for i := 0; i < num; i++ {
-		c := t.NewClient(d5pArray[i], dhKeys)
-		mgr.clients[i] = c
-		go c.StartSigTun(false)
+func NewClientMgr(d5c *t.D5ClientConf) *clientMgr {
+	mgr := &clientMgr{
+		dhKeys: t.GenerateDHKeyPairs(),
+		lock:   new(sync.Mutex),
 	}
+	mgr.update(d5c)
 	return mgr
 }
 
+// the local listeners dispatching requests to the clients
+type clientService struct {
+	mgr       *clientMgr
+	frontends map[string]*frontendEntry
+	wg        sync.WaitGroup
+	lock      sync.Locker
+}
+
+type frontendEntry struct {
+	ln       net.Listener
+	frontend *t.Frontend
+}
+
+func (s *clientService) _listen(l *t.Listener, conf *t.D5ClientConf) error {
+	ln, err := l.Listen()
+	if err != nil {
+		return err
+	}
+	var key, entry = l.String(), &frontendEntry{ln, t.NewFrontend(conf, l, s.mgr)}
+	s.frontends[key] = entry
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		err := entry.frontend.ServeListener(ln)
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.frontends[key] == entry { // not closed by reloading
+			log.Errorln(err)
+		}
+	}()
+	log.Infoln("Proxy is working at", l)
+	return nil
+}
+
+// serve until all the listeners were closed
+func (s *clientService) serve(conf *t.D5ClientConf) {
+	s.lock.Lock()
+	for _, l := range conf.Listeners {
+		if err := s._listen(l, conf); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	s.lock.Unlock()
+	s.wg.Wait()
+}
+
+// the unchanged listeners and tunnels are kept
+func (s *clientService) Reload(config string) {
+	var conf = t.Parse_d5cFile(config)
+	context.setLogVerbose(conf.Verbose)
+	started, closed := s.mgr.update(conf)
+	log.Infof("Gateways were reloaded, %d started, %d closed\n", started, closed)
+	// hold on while replacing all listeners
+	s.wg.Add(1)
+	defer s.wg.Done()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var removed = make(map[string]*frontendEntry)
+	for key, entry := range s.frontends {
+		removed[key] = entry
+	}
+	for _, l := range conf.Listeners {
+		if entry, y := removed[l.String()]; y {
+			entry.frontend.Reload(conf)
+			delete(removed, l.String())
+		}
+	}
+	// release the addresses before listening the new
+	for key, entry := range removed {
+		delete(s.frontends, key)
+		entry.ln.Close()
+		log.Infoln("Proxy stopped at", key)
+	}
+	for _, l := range conf.Listeners {
+		if _, y := s.frontends[l.String()]; !y {
+			if err := s._listen(l, conf); err != nil {
+				log.Errorln(err)
+			}
+		}
+	}
+}
+
 func (context *bootContext) startClient() {
 	defer func() {
 		ex.CatchException(recover())
@@ -175,24 +353,25 @@ func (context *bootContext) startClient() {
 	var conf = t.Parse_d5cFile(context.config)
 	context.setLogVerbose(conf.Verbose)
 	log.Info(versionString())
-	log.Infoln("Socks5/Http is working at", conf.ListenAddr)
-
-	mgr := NewClientMgr(conf)
-	context.statser = mgr
 
-	ln, err := net.ListenTCP("tcp", conf.ListenAddr)
-	if err != nil {
-		log.Fatalln(err)
-	}
-	defer ln.Close()
-	for {
-		conn, err := ln.Accept()
-		if err == nil {
-			go mgr.selectClientServ(conn)
-		} else {
-			t.SafeClose(conn)
-		}
+	service := &clientService{
+		mgr:       NewClientMgr(conf),
+		frontends: make(map[string]*frontendEntry),
+		lock:      new(sync.Mutex),
 	}
+	context.statser = service.mgr
+	context.reloader = service
+	service.serve(conf)
+}
+
+type serverService struct {
+	server *t.Server
+}
+
+func (s *serverService) Reload(config string) {
+	var conf = t.Parse_d5sFile(config)
+	context.setLogVerbose(conf.Verbose)
+	s.server.Reload(conf)
 }
 
 func (context *bootContext) startServer() {
@@ -214,6 +393,8 @@ func (context *bootContext) startServer() {
 	dhKeys := t.GenerateDHKeyPairs()
 	server := t.NewServer(conf, dhKeys)
 	context.statser = server
+	context.drainer = server
+	context.reloader = &serverService{server}
 	for {
 		conn, err := ln.AcceptTCP()
 		if err == nil {
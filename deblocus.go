@@ -11,19 +11,40 @@ import (
 )
 
 var context = &bootContext{}
-var sigChan = make(chan os.Signal)
+var sigChan = make(chan os.Signal, 1)
+
+// repeatable -set Field=Value
+type overrideFlag struct{}
+
+func (overrideFlag) String() string {
+	return ""
+}
+
+func (overrideFlag) Set(literal string) error {
+	return t.SetOverride(literal)
+}
 
 func waitSignal() {
 	USR2 := syscall.Signal(12) // fake signal-USR2 for windows
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, USR2)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGHUP, USR2)
 	for sig := range sigChan {
 		switch sig {
 		case t.Bye:
 			log.Exitln("Exiting.")
 			return
-		case syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM:
+		// the server drains at the first, then exits at the second.
+		case syscall.SIGTERM, syscall.SIGINT:
+			if context.drain() {
+				log.Infoln("Draining by", sig)
+				continue
+			}
+			log.Exitln("Terminated by", sig)
+			return
+		case syscall.SIGQUIT: // exits immediately without draining
 			log.Exitln("Terminated by", sig)
 			return
+		case syscall.SIGHUP:
+			go context.reload()
 		case USR2:
 			context.doStats()
 		default:
@@ -41,6 +62,10 @@ func main() {
 	flag.BoolVar(&context.csc, "csc", false, "Server;;Create Server Config")
 	flag.BoolVar(&context.icc, "icc", false, "Server;;Issue Client Credential for user//-icc <Server public address> <User1> <User2>...")
 	flag.BoolVar(&context.isServ, "serv", false, "Server;;run as Server explicitly")
+	flag.BoolVar(&context.toJSON, "json", false, "Convert the Config into JSON format//-json -config deblocus.d5c -o deblocus.d5c.json")
+	flag.BoolVar(&context.check, "t", false, "Test the Config then exit without running")
+	flag.Var(overrideFlag{}, "set", "override the config field, prior to env DEBLOCUS_<FIELD>//-set QueueLimit=8M -set Verbose=2")
+	flag.BoolVar(&context.dump, "dump", false, "Dump the effective config values then exit")
 	flag.BoolVar(&showVersion, "V", false, "show Version")
 	flag.StringVar(&context.verbosity, "v", "", "Verbose log level")
 	flag.StringVar(&logDir, "logdir", "", "if non-empty will write log into the Directory")
@@ -66,6 +91,20 @@ func main() {
 		return
 	}
 
+	if context.check {
+		os.Exit(context.checkConfig())
+	}
+
+	if context.dump {
+		context.dumpConfig()
+		return
+	}
+
+	if context.toJSON {
+		context.convert(output)
+		return
+	}
+
 	if context.isServ {
 		go context.startServer()
 	} else {
@@ -0,0 +1,85 @@
+package tunnel
+
+import (
+	"github.com/spance/deblocus/exception"
+	"hash/fnv"
+	"net"
+	"strings"
+)
+
+const (
+	AFFINITY_OFF = iota
+	AFFINITY_DEST
+	AFFINITY_SOURCE
+)
+
+var (
+	UNKNOWN_AFFINITY = exception.NewW("Unknown affinity")
+	affinityNames    = []string{"off", "dest", "source"}
+)
+
+// Affinity pins the requests of the same destination host or the same
+// client source to one client.
+type Affinity int
+
+func parseAffinity(name string) (Affinity, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == NULL {
+		return AFFINITY_OFF, nil
+	}
+	for i, n := range affinityNames {
+		if n == name {
+			return Affinity(i), nil
+		}
+	}
+	return AFFINITY_OFF, UNKNOWN_AFFINITY.Apply(name)
+}
+
+// returns the sticky key of request, or empty if the affinity is off
+func (a Affinity) Key(target string, src net.Addr) string {
+	switch a {
+	case AFFINITY_DEST:
+		if host, _, e := net.SplitHostPort(target); e == nil {
+			return strings.ToLower(host)
+		}
+		return strings.ToLower(target)
+	case AFFINITY_SOURCE:
+		if src != nil {
+			return ipAddr(src)
+		}
+	}
+	return NULL
+}
+
+func (a Affinity) String() string {
+	return affinityNames[a]
+}
+
+// rendezvous hashing, the key will stay on the same client as long as it's
+// in the candidates, and will move to the next one deterministically if not.
+func ChooseByKey(key string, clients []*Client) *Client {
+	var (
+		selected *Client
+		max      uint64
+	)
+	for _, c := range clients {
+		h := fnv.New64a()
+		h.Write([]byte(c.nego.RemoteName()))
+		h.Write([]byte{0})
+		h.Write([]byte(key))
+		if score := fmix64(h.Sum64()); selected == nil || score > max {
+			selected, max = c, score
+		}
+	}
+	return selected
+}
+
+// finalizer of murmur3, fnv alone spreads poorly in the high bits
+func fmix64(k uint64) uint64 {
+	k ^= k >> 33
+	k *= 0xff51afd7ed558ccd
+	k ^= k >> 33
+	k *= 0xc4ceb9fe1a85ec53
+	k ^= k >> 33
+	return k
+}
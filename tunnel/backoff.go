@@ -0,0 +1,151 @@
+package tunnel
+
+import (
+	"fmt"
+	log "github.com/spance/deblocus/golang/glog"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	BACKOFF_BASE   = time.Second
+	BACKOFF_MAX    = time.Minute
+	BACKOFF_STABLE = time.Minute
+	// the breaker will be open after the consecutive failures
+	BREAKER_THRESHOLD = 3
+)
+
+// exponential backoff with jitter for reconnecting, the failures will be
+// forgotten once the connection was kept stable.
+type backoff struct {
+	name      string
+	lock      sync.Locker
+	base      time.Duration
+	max       time.Duration
+	stable    time.Duration
+	failures  int
+	connected time.Time
+	retryAt   time.Time
+	probing   bool // a dial was admitted in half-open
+}
+
+func newBackoff(name string, conf *backoffConf) *backoff {
+	return &backoff{
+		name:   name,
+		lock:   new(sync.Mutex),
+		base:   conf.base,
+		max:    conf.max,
+		stable: conf.stable,
+	}
+}
+
+// the pending retry is not affected
+func (b *backoff) configure(conf *backoffConf) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.base, b.max, b.stable = conf.base, conf.max, conf.stable
+}
+
+// sleep before reconnecting, the concurrent callers failed in the same outage
+// will join the pending retry and be counted as one failure.
+func (b *backoff) wait() {
+	b.lock.Lock()
+	if d := b.retryAt.Sub(time.Now()); d > 0 && b.connected.IsZero() {
+		b.lock.Unlock()
+		time.Sleep(d)
+		return
+	}
+	if !b.connected.IsZero() && time.Since(b.connected) >= b.stable {
+		b.failures = 0
+	}
+	b.connected, b.probing = time.Time{}, false
+	var d = b.max
+	if b.failures < 32 && b.base<<uint(b.failures) < b.max {
+		d = b.base << uint(b.failures)
+	}
+	// jitter in [d/2, d]
+	d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+	b.failures++
+	b.retryAt = time.Now().Add(d)
+	b.lock.Unlock()
+	log.Infof("Reconnect %s after %s\n", b.name, d/time.Millisecond*time.Millisecond)
+	time.Sleep(d)
+}
+
+func (b *backoff) succeeded() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.connected, b.probing = time.Now(), false
+}
+
+// blocks the dialing while the breaker is open, and only one dial will be
+// admitted as the probe in half-open until it succeeded or failed.
+// returns false if aborted meanwhile.
+func (b *backoff) admit(aborted func() bool) bool {
+	for !aborted() {
+		b.lock.Lock()
+		var d = b.base // polling the result of probe
+		switch {
+		case !b.connected.IsZero() || b.failures < BREAKER_THRESHOLD:
+			b.lock.Unlock()
+			return true
+		case time.Now().Before(b.retryAt):
+			d = b.retryAt.Sub(time.Now())
+		case !b.probing:
+			b.probing = true
+			b.lock.Unlock()
+			return true
+		}
+		b.lock.Unlock()
+		time.Sleep(d)
+	}
+	return false
+}
+
+// circuit breaker state: closed, open while waiting after consecutive
+// failures, or half-open while retrying.
+func (b *backoff) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch {
+	case !b.connected.IsZero() || b.failures < BREAKER_THRESHOLD:
+		return "closed"
+	case time.Now().Before(b.retryAt):
+		return fmt.Sprintf("open(%d retry in %s)", b.failures, b.retryAt.Sub(time.Now())/time.Second*time.Second)
+	case b.probing:
+		return "half-open(probing)"
+	}
+	return "half-open"
+}
+
+type backoffConf struct {
+	base, max, stable time.Duration
+}
+
+// base,max[,stable]
+func parseBackoff(literal string) (*backoffConf, error) {
+	var (
+		conf   = &backoffConf{BACKOFF_BASE, BACKOFF_MAX, BACKOFF_STABLE}
+		fields = []*time.Duration{&conf.base, &conf.max, &conf.stable}
+		items  = strings.Split(literal, ",")
+	)
+	if strings.TrimSpace(literal) == NULL {
+		return conf, nil
+	}
+	if len(items) < 2 || len(items) > len(fields) {
+		return nil, CONF_ERROR.Apply("Backoff " + literal)
+	}
+	for i, item := range items {
+		d, e := time.ParseDuration(strings.TrimSpace(item))
+		if e != nil || d <= 0 {
+			return nil, CONF_ERROR.Apply("Backoff " + literal)
+		}
+		*fields[i] = d
+	}
+	if conf.max < conf.base {
+		return nil, CONF_ERROR.Apply("Backoff " + literal)
+	}
+	return conf, nil
+}
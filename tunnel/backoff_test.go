@@ -0,0 +1,109 @@
+package tunnel
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_backoff(t *testing.T) {
+	conf, e := parseBackoff("1ms, 8ms, 50ms")
+	if e != nil {
+		t.Fatal(e)
+	}
+	var b = newBackoff("test", conf)
+	for i, max := range []time.Duration{1, 2, 4, 8, 8} {
+		max *= time.Millisecond
+		start := time.Now()
+		b.wait()
+		if d := b.retryAt.Sub(start); d < max/2 || d > max+time.Millisecond {
+			t.Fatalf("attempt %d waited %s, expected [%s, %s]", i, d, max/2, max)
+		}
+	}
+	if s := b.String(); s != "half-open" {
+		t.Fatalf("breaker=%s after failures", s)
+	}
+	b.succeeded()
+	if s := b.String(); s != "closed" {
+		t.Fatalf("breaker=%s after connected", s)
+	}
+	b.wait() // the short-lived connection is still failure
+	if b.failures != 6 {
+		t.Fatalf("failures=%d", b.failures)
+	}
+	b.succeeded()
+	time.Sleep(conf.stable)
+	b.wait()
+	if b.failures != 1 {
+		t.Fatalf("failures=%d were not reset after stable", b.failures)
+	}
+	b.failures = BREAKER_THRESHOLD
+	b.retryAt = time.Now().Add(time.Minute)
+	if s := b.String(); !strings.HasPrefix(s, "open") {
+		t.Fatalf("breaker=%s while waiting", s)
+	}
+	// the tuns broken together are one failure
+	b.succeeded()
+	time.Sleep(conf.stable)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.wait()
+		}()
+	}
+	wg.Wait()
+	if b.failures != 1 {
+		t.Fatalf("failures=%d of one outage", b.failures)
+	}
+	for _, bad := range []string{"1s", "1s,x", "2s,1s", "1s,2s,3s,4s"} {
+		if _, e := parseBackoff(bad); e == nil {
+			t.Errorf("%q was accepted", bad)
+		}
+	}
+}
+
+func Test_breakerProbe(t *testing.T) {
+	conf, _ := parseBackoff("1ms, 8ms")
+	var (
+		b        = newBackoff("test", conf)
+		admitted = make(chan bool, 3)
+		never    = func() bool { return false }
+	)
+	b.failures = BREAKER_THRESHOLD
+	b.retryAt = time.Now().Add(time.Millisecond * 50)
+	for i := 0; i < 3; i++ {
+		go func() {
+			admitted <- b.admit(never)
+		}()
+	}
+	time.Sleep(time.Millisecond * 20)
+	if len(admitted) != 0 {
+		t.Fatalf("dialed while open")
+	}
+	time.Sleep(time.Millisecond * 60)
+	if n := len(admitted); n != 1 || b.String() != "half-open(probing)" {
+		t.Fatalf("admitted %d probes in %s", n, b)
+	}
+	b.succeeded()
+	for i := 0; i < 3; i++ {
+		select {
+		case <-admitted:
+		case <-time.After(time.Second):
+			t.Fatalf("not admitted after the probe succeeded")
+		}
+	}
+	// the failed probe opens again
+	b.failures, b.retryAt, b.connected = BREAKER_THRESHOLD, time.Now(), time.Time{}
+	b.admit(never)
+	start := time.Now()
+	b.wait()
+	if b.probing || b.failures != BREAKER_THRESHOLD+1 || !b.retryAt.After(start) {
+		t.Fatalf("breaker=%s failures=%d after the failed probe", b, b.failures)
+	}
+	if b.admit(func() bool { return true }) {
+		t.Fatalf("admitted after aborted")
+	}
+}
@@ -0,0 +1,120 @@
+package tunnel
+
+import (
+	"github.com/spance/deblocus/exception"
+	"strings"
+	"time"
+)
+
+const (
+	BALANCE_ROUND_ROBIN   = "roundrobin"
+	BALANCE_WEIGHTED      = "weighted"
+	BALANCE_LEAST_STREAMS = "leaststreams"
+	BALANCE_LOWEST_RTT    = "lowestrtt"
+	BALANCE_FAILOVER      = "failover"
+)
+
+var (
+	UNKNOWN_BALANCE = exception.NewW("Unknown balance strategy")
+)
+
+// BalanceStrategy chooses the client for new request from the non-empty
+// available clients, which are in the order of d5p fragments.
+type BalanceStrategy interface {
+	Choose(clients []*Client) *Client
+}
+
+func parseBalanceStrategy(name string) (BalanceStrategy, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case NULL, BALANCE_ROUND_ROBIN:
+		return new(RoundRobinBalance), nil
+	case BALANCE_WEIGHTED:
+		return &WeightedBalance{current: make(map[*Client]int)}, nil
+	case BALANCE_LEAST_STREAMS:
+		return new(LeastStreamsBalance), nil
+	case BALANCE_LOWEST_RTT:
+		return new(LowestRTTBalance), nil
+	case BALANCE_FAILOVER:
+		return new(FailoverBalance), nil
+	}
+	return nil, UNKNOWN_BALANCE.Apply(name)
+}
+
+type RoundRobinBalance struct {
+	next int
+}
+
+func (b *RoundRobinBalance) Choose(clients []*Client) *Client {
+	b.next++
+	return clients[b.next%len(clients)]
+}
+
+// smooth weighted round-robin by the weight of d5p
+type WeightedBalance struct {
+	current map[*Client]int
+}
+
+func (b *WeightedBalance) Choose(clients []*Client) *Client {
+	var (
+		selected *Client
+		total    int
+	)
+	for _, c := range clients {
+		w := c.Weight()
+		total += w
+		b.current[c] += w
+		if selected == nil || b.current[c] > b.current[selected] {
+			selected = c
+		}
+	}
+	b.current[selected] -= total
+	return selected
+}
+
+// the ties will be chosen in turn
+type LeastStreamsBalance struct {
+	next int
+}
+
+func (b *LeastStreamsBalance) Choose(clients []*Client) *Client {
+	var (
+		selected *Client
+		min      int
+		n        = len(clients)
+	)
+	for i := 0; i < n; i++ {
+		c := clients[(b.next+i)%n]
+		if s := c.ActiveStreams(); selected == nil || s < min {
+			selected, min = c, s
+		}
+	}
+	b.next++
+	return selected
+}
+
+type LowestRTTBalance struct {
+	next int
+}
+
+func (b *LowestRTTBalance) Choose(clients []*Client) *Client {
+	var (
+		selected *Client
+		min      time.Duration
+		n        = len(clients)
+	)
+	for i := 0; i < n; i++ {
+		c := clients[(b.next+i)%n]
+		if rtt := c.RTT(); selected == nil || rtt < min {
+			selected, min = c, rtt
+		}
+	}
+	b.next++
+	return selected
+}
+
+// the first available in order
+type FailoverBalance struct{}
+
+func (b *FailoverBalance) Choose(clients []*Client) *Client {
+	return clients[0]
+}
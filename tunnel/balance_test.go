@@ -0,0 +1,96 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestClient(weight int, rtt time.Duration, streams int32) *Client {
+	c := NewClient(&D5Params{weight: weight}, nil)
+	c.mux = NewClientMultiplexer()
+	c.mux.router.stopCleanTask()
+	c.mux.pool.Push(&Conn{rtt: int64(rtt), streams: streams})
+	return c
+}
+
+func Test_balanceStrategy(t *testing.T) {
+	var (
+		a       = newTestClient(5, 30*time.Millisecond, 2)
+		b       = newTestClient(1, 10*time.Millisecond, 4)
+		c       = newTestClient(1, 20*time.Millisecond, 1)
+		clients = []*Client{a, b, c}
+	)
+	var expected = map[string][]*Client{
+		BALANCE_ROUND_ROBIN:   {b, c, a, b},
+		BALANCE_WEIGHTED:      {a, a, b, a, c, a, a, a},
+		BALANCE_LEAST_STREAMS: {c, c},
+		BALANCE_LOWEST_RTT:    {b, b},
+		BALANCE_FAILOVER:      {a, a},
+	}
+	for name, sequence := range expected {
+		s, e := parseBalanceStrategy(name)
+		if e != nil {
+			t.Fatal(e)
+		}
+		for i, x := range sequence {
+			if y := s.Choose(clients); x != y {
+				t.Fatalf("%s: choice %d expected weight=%d rtt=%s but weight=%d rtt=%s",
+					name, i, x.Weight(), x.RTT(), y.Weight(), y.RTT())
+			}
+		}
+	}
+	if _, e := parseBalanceStrategy("random"); e == nil {
+		t.Fatalf("unknown strategy was accepted")
+	}
+}
+
+func Test_affinity(t *testing.T) {
+	var clients = make([]*Client, 4)
+	for i := range clients {
+		clients[i] = NewClient(&D5Params{d5sAddrStr: fmt.Sprintf("s%d:9008", i)}, nil)
+	}
+	dest, e := parseAffinity("dest")
+	if e != nil {
+		t.Fatal(e)
+	}
+	var (
+		key    = dest.Key("www.example.com:443", nil)
+		pinned = ChooseByKey(key, clients)
+	)
+	if key != dest.Key("WWW.example.com:80", nil) {
+		t.Fatalf("key of the same host differs")
+	}
+	// failover deterministically and the others are kept
+	var rest []*Client
+	for _, c := range clients {
+		if c != pinned {
+			rest = append(rest, c)
+		}
+	}
+	next := ChooseByKey(key, rest)
+	for i := 0; i < 3; i++ {
+		if ChooseByKey(key, clients) != pinned || ChooseByKey(key, rest) != next {
+			t.Fatalf("unstable choice")
+		}
+	}
+	var counts = make(map[*Client]int)
+	for i := 0; i < 100; i++ {
+		counts[ChooseByKey(fmt.Sprintf("host%d", i), clients)]++
+	}
+	if len(counts) != len(clients) {
+		t.Fatalf("keys were not spread %v", counts)
+	}
+	src, _ := parseAffinity("source")
+	if k := src.Key("a:80", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234}); k != "10.0.0.1" {
+		t.Fatalf("source key %s", k)
+	}
+	off, _ := parseAffinity("")
+	if off.Key("a:80", nil) != NULL {
+		t.Fatalf("key with affinity off")
+	}
+	if _, e = parseAffinity("random"); e == nil {
+		t.Fatalf("unknown affinity was accepted")
+	}
+}
@@ -0,0 +1,212 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/spance/deblocus/auth"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// a problem of the config file, the line is 0 if it's about the whole file.
+type ConfProblem struct {
+	File string
+	Line int
+	Err  interface{}
+}
+
+func (p *ConfProblem) String() string {
+	if p.Line > 0 {
+		return fmt.Sprintf("%s:%d: %v", p.File, p.Line, p.Err)
+	}
+	return fmt.Sprintf("%s: %v", p.File, p.Err)
+}
+
+type confChecker struct {
+	file     string
+	desc     ImportableFieldDesc
+	kParse   keyParser
+	lines    map[string]int    // where the fields were set in file
+	origins  map[string]string // the env or flag overriding the fields
+	problems []*ConfProblem
+}
+
+func (c *confChecker) report(file string, line int, err interface{}) {
+	c.problems = append(c.problems, &ConfProblem{file, line, err})
+}
+
+// the exception thrown by f will be reported as the problem of line
+func (c *confChecker) try(line int, f func()) {
+	c.tryAt(c.file, line, f)
+}
+
+func (c *confChecker) tryAt(file string, line int, f func()) {
+	defer func() {
+		if e := recover(); e != nil {
+			c.report(file, line, e)
+		}
+	}()
+	f()
+}
+
+func (c *confChecker) directive(line int, k, v string) {
+	if v == NULL {
+		c.report(c.file, line, UNRECOGNIZED_SYMBOLS.Apply(k))
+		return
+	}
+	d, y := c.desc[k]
+	if !y {
+		c.report(c.file, line, UNRECOGNIZED_DIRECTIVES.Apply(k))
+		return
+	}
+	if prev, y := c.lines[k]; y {
+		c.report(c.file, line, CONF_ERROR.Apply(fmt.Sprintf("%s was set at line %d", k, prev)))
+		return
+	}
+	c.lines[k] = line
+	c.try(line, func() {
+		d.set(v)
+	})
+}
+
+// the problem of field is reported where it was set
+func (c *confChecker) field(field string, e error) {
+	if origin, y := c.origins[field]; y {
+		c.report(origin, 0, e)
+	} else {
+		c.report(c.file, c.lines[field], e)
+	}
+}
+
+func (c *confChecker) key(line int, block []byte) {
+	c.try(line, func() {
+		c.kParse(block)
+	})
+}
+
+func (c *confChecker) readJSON(data []byte) {
+	members, e := readJSONMembers(data)
+	if e != nil {
+		var line int
+		if se, y := e.(*json.SyntaxError); y {
+			line = lineAt(data, se.Offset)
+		}
+		c.report(c.file, line, CONF_ERROR.Apply(e))
+		return
+	}
+	for _, m := range members {
+		var k, raw, line = m.key, m.value, m.line
+		if k == JSON_KEYS {
+			var keys []string
+			if e := json.Unmarshal(raw, &keys); e != nil {
+				c.report(c.file, line, CONF_ERROR.Apply(k+" "+e.Error()))
+			}
+			for _, key := range keys {
+				c.key(line, []byte(key))
+			}
+			continue
+		}
+		d, y := c.desc[k]
+		if !y {
+			c.report(c.file, line, UNRECOGNIZED_DIRECTIVES.Apply(k))
+			continue
+		}
+		var v string
+		c.try(line, func() {
+			var value interface{}
+			if e := json.Unmarshal(raw, &value); e != nil {
+				panic(CONF_ERROR.Apply(k + " " + e.Error()))
+			}
+			if value != nil {
+				v = d.literal(value)
+			}
+		})
+		if v != NULL {
+			c.directive(line, k, v)
+		}
+	}
+}
+
+// the secret file should not be accessible by the others
+func (c *confChecker) checkMode(file string, mask os.FileMode) {
+	if runtime.GOOS == "windows" {
+		return
+	}
+	if fi, e := os.Stat(file); e == nil && fi.Mode().Perm()&mask != 0 {
+		c.report(file, 0, CONF_ERROR.Apply(fmt.Sprintf("permissions %#o are too open", fi.Mode().Perm())))
+	}
+}
+
+// parse and validate the config file without any binding, returns all the
+// problems were found in order.
+func CheckConfFile(path string, isServ bool) []*ConfProblem {
+	var (
+		c = &confChecker{
+			file:    path,
+			lines:   make(map[string]int),
+			origins: make(map[string]string),
+		}
+		d5c   = new(D5ClientConf)
+		d5s   = new(D5ServConf)
+		check func(report func(field string, e error))
+	)
+	if isServ {
+		c.desc, check = getImportableDesc(d5s), d5s.check
+		c.kParse = func(block []byte) {
+			d5s.RSAKeys = parse_d5sPrivateKey(block)
+		}
+	} else {
+		c.desc, check = getImportableDesc(d5c), d5c.check
+		c.kParse = func(block []byte) {
+			d5c.D5PList = append(d5c.D5PList, parse_d5pFragment(block))
+		}
+	}
+	data, e := ioutil.ReadFile(path)
+	if e != nil {
+		c.report(path, 0, e)
+		return c.problems
+	}
+	if isJSONConf(path) {
+		c.readJSON(data)
+	} else {
+		c.try(0, func() {
+			readD5Conf(bytes.NewReader(data), c.directive, c.key)
+		})
+	}
+	overrides, e := getOverrides(c.desc)
+	if e != nil {
+		c.report(path, 0, e)
+	}
+	for _, o := range overrides {
+		var d = c.desc[o.field]
+		c.origins[o.field] = o.origin
+		c.tryAt(o.origin, 0, func() {
+			d.set(o.value)
+		})
+	}
+	// the credentials in d5p or the private key
+	c.checkMode(path, 077)
+	var authFile = isServ && strings.HasPrefix(d5s.AuthTable, "file://")
+	if authFile {
+		table := d5s.AuthTable[7:]
+		auth.CheckFileAuthSys(table, func(line int, e error) {
+			c.report(table, line, e)
+		})
+		c.checkMode(table, 007)
+	}
+	check(func(field string, e error) {
+		// the auth file was checked line by line
+		if !(authFile && field == "AuthTable") {
+			c.field(field, e)
+		}
+	})
+	sort.SliceStable(c.problems, func(i, j int) bool {
+		a, b := c.problems[i], c.problems[j]
+		return a.File < b.File || a.File == b.File && a.Line < b.Line
+	})
+	return c.problems
+}
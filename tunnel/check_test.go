@@ -0,0 +1,73 @@
+package tunnel
+
+import (
+	"github.com/spance/deblocus/auth"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func Test_checkConfFile(t *testing.T) {
+	dir, e := ioutil.TempDir("", "deblocus")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	var (
+		d5s  = &D5ServConf{Listen: "127.0.0.1:9008", ServerName: "test", Algo: "AES128CFB", RSAKeys: testRSAKeys(t)}
+		d5p  = d5s.Export_d5p(&auth.User{Name: "u", Pass: "p"})
+		file = filepath.Join(dir, "deblocus.d5c")
+	)
+	var check = func(conf string, lines ...int) {
+		if e := ioutil.WriteFile(file, []byte(conf), 0600); e != nil {
+			t.Fatal(e)
+		}
+		problems := CheckConfFile(file, false)
+		if len(problems) != len(lines) {
+			t.Fatalf("expected %d problems but %v", len(lines), problems)
+		}
+		for i, p := range problems {
+			if p.Line != lines[i] {
+				t.Fatalf("expected problem at line %d but %s", lines[i], p)
+			}
+		}
+	}
+	check("Listen :9009\n" + d5p)
+	check("Listen :9009 foo@:1080\n# comment\nBalance random\nVerbose x\nVerbose\n"+d5p, 1, 3, 4, 5)
+	// every fragment
+	check("Listen :9009\n"+d5p+"-----BEGIN x-----\n-----END x-----\n", strings.Count(d5p, "\n")+2)
+	check("Listen :9009\n", 0)
+	// rejected by the loader too
+	check("Listen :9009\nVerbose 1\nVerbose 2\n"+d5p, 3)
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("the duplicate key was loaded")
+			}
+		}()
+		Parse_d5cFile(file)
+	}()
+	// the problems of fields found by validating
+	check("Listen :9009\nBackoff x\nProbe :80,0\n"+d5p, 2, 3)
+	os.Setenv(ENV_PREFIX+"BALANCE", "random")
+	problems := CheckConfFile(file, false)
+	os.Unsetenv(ENV_PREFIX + "BALANCE")
+	if len(problems) != 3 || problems[2].File != ENV_PREFIX+"BALANCE" {
+		t.Fatalf("expected the problem of env but %v", problems)
+	}
+	// the credentials of d5p
+	if runtime.GOOS != "windows" {
+		check("Listen :9009\n" + d5p)
+		os.Chmod(file, 0644)
+		if problems := CheckConfFile(file, false); len(problems) != 1 || problems[0].Line != 0 {
+			t.Fatalf("expected the problem of permissions but %v", problems)
+		}
+	}
+	file += JSON_SUFFIX
+	check("{\n  \"Listen\": [\":9009\"],\n  \"Affinity\": \"sticky\"\n}\n", 0, 3)
+	// the key in value, and the duplicate key
+	check("{\n  \"Balance\": \"Affinity\",\n  \"Affinity\": \"sticky\",\n  \"Listen\": \":9009\",\n  \"Listen\": \":9009\"\n}\n", 0, 2, 3, 5)
+}
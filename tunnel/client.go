@@ -4,7 +4,6 @@ import (
 	"fmt"
 	ex "github.com/spance/deblocus/exception"
 	log "github.com/spance/deblocus/golang/glog"
-	"net"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -13,6 +12,14 @@ import (
 const (
 	RETRY_INTERVAL = time.Second * 5
 	REST_INTERVAL  = RETRY_INTERVAL
+	// checking load of tuns for scaling
+	SCALE_INTERVAL = time.Second * 10
+	// add tun if exceeded per tun
+	SCALE_STREAMS_HIGH = 16
+	SCALE_TRAFFIC_HIGH = 4 << 20 // bytes per second
+	// the tun without stream and traffic below it will be retired
+	SCALE_TRAFFIC_IDLE = 1024
+	RETIRE_GRACE       = time.Second * 2
 )
 
 type Client struct {
@@ -20,10 +27,16 @@ type Client struct {
 	mux         *multiplexer
 	token       []byte
 	nego        *d5CNegotiation
+	settings    atomic.Value // *D5Params, the latest of the same fingerprint
 	tp          *tunParams
 	lock        sync.Locker
 	dtCnt       int32
 	State       int32 // -1:aborted 0:working 1:requesting token
+	goaway      int32 // the gateway is draining
+	closed      int32 // removed from the config
+	health      *healthStats
+	stBackoff   *backoff
+	dtBackoff   *backoff
 	waitTK      *sync.Cond
 	pendingSema *semaphore
 }
@@ -45,12 +58,20 @@ func NewClient(d5p *D5Params, dhKeys *DHKeyPair) *Client {
 	clt := &Client{
 		lock:        new(sync.Mutex),
 		nego:        new(d5CNegotiation),
+		health:      newHealthStats(),
 		pendingSema: NewSemaphore(),
 	}
 	clt.waitTK = sync.NewCond(clt.lock)
 	// set parameters
 	clt.nego.D5Params = d5p
+	clt.settings.Store(d5p)
 	clt.nego.dhKeys = dhKeys
+	var conf = d5p.backoff
+	if conf == nil {
+		conf, _ = parseBackoff(NULL)
+	}
+	clt.stBackoff = newBackoff("ST of "+d5p.RemoteName(), conf)
+	clt.dtBackoff = newBackoff("DT of "+d5p.RemoteName(), conf)
 	return clt
 }
 
@@ -59,7 +80,7 @@ func (c *Client) StartSigTun(again bool) {
 		if err := recover(); err != nil {
 			c.eventHandler(evt_st_closed, true)
 		} else {
-			c.eventHandler(evt_st_ready, c.sigTun.tun.identifier)
+			c.eventHandler(evt_st_ready, c.getSigTun().tun.identifier)
 		}
 	}()
 	if again {
@@ -71,23 +92,42 @@ func (c *Client) StartSigTun(again bool) {
 				}
 			}
 		*/
-		time.Sleep(RETRY_INTERVAL)
+		c.stBackoff.wait()
 	}
+	ThrowIf(!c.stBackoff.admit(c.isClosed), "Client was closed")
 	stConn, tp := c.nego.negotiate()
 	stConn.identifier = c.nego.RemoteName()
+	// the closing should see the final sigTun
+	c.lock.Lock()
+	if c.isClosed() {
+		c.lock.Unlock()
+		SafeClose(stConn)
+		panic("Client was closed")
+	}
 	c.tp, c.token = tp, tp.token
 	c.sigTun = NewSignalTunnel(stConn, tp.stInterval)
-	go c.sigTun.start(c.eventHandler)
+	var st = c.sigTun
+	c.lock.Unlock()
+	go st.start(c.eventHandler)
 }
 
 // when sigTun is ready
 func (c *Client) startMultiplexer() {
+	c.lock.Lock()
 	if c.mux == nil {
-		c.mux = NewClientMultiplexer()
+		mux := NewClientMultiplexer()
+		mux.configure(c.params().muxSettings())
+		c.mux = mux
+		c.lock.Unlock()
 		for i := c.tp.tunQty; i > 0; i-- {
 			go c.startDataTun(false)
 		}
+		if c.tp.tunMax > c.tp.tunQty {
+			go c.scaleLoop()
+		}
+		go c.healthLoop()
 	} else {
+		c.lock.Unlock()
 		c.pendingSema.notifyAll()
 	}
 }
@@ -99,7 +139,7 @@ func (c *Client) startDataTun(again bool) {
 			atomic.AddInt32(&c.dtCnt, -1)
 		}
 		if err := recover(); err != nil {
-			log.Errorf("DTun failed to connect(%s). Retry after %s\n", err, RETRY_INTERVAL)
+			log.Errorf("DTun failed to connect(%s)\n", err)
 			c.eventHandler(evt_dt_closed, true)
 			if DEBUG {
 				ex.CatchException(err)
@@ -107,18 +147,22 @@ func (c *Client) startDataTun(again bool) {
 		}
 	}()
 	if again {
-		time.Sleep(RETRY_INTERVAL)
+		c.dtBackoff.wait()
 	}
-	for {
+	for !c.isClosed() {
 		if atomic.LoadInt32(&c.State) == 0 {
+			if !c.dtBackoff.admit(c.isClosed) {
+				break
+			}
 			conn := c.createDataTun()
 			connected = true
+			c.dtBackoff.succeeded()
 			if log.V(1) {
 				log.Infof("DTun(%s) is established\n", conn.sign())
 			}
 			atomic.AddInt32(&c.dtCnt, 1)
-			c.mux.Listen(conn, c.eventHandler, c.tp.dtInterval)
-			log.Errorf("DTun(%s) was disconnected. Reconnect after %s\n", conn.sign(), RETRY_INTERVAL)
+			c.getMux().Listen(conn, c.eventHandler, c.tp.dtInterval)
+			log.Errorf("DTun(%s) was disconnected\n", conn.sign())
 			break
 		} else {
 			c.pendingSema.acquire(RETRY_INTERVAL)
@@ -132,13 +176,26 @@ func (c *Client) eventHandler(e event, msg ...interface{}) {
 	case evt_st_closed:
 		atomic.StoreInt32(&c.State, -1)
 		c.clearTokens()
-		log.Errorf("Lost connection of gateway %s. Reconnect after %s\n", c.nego.RemoteName(), RETRY_INTERVAL)
+		if c.isClosed() {
+			break
+		}
+		log.Errorf("Lost connection of gateway %s\n", c.nego.RemoteName())
 		go c.StartSigTun(mlen > 0)
 	case evt_st_ready:
+		c.stBackoff.succeeded()
 		atomic.StoreInt32(&c.State, 0)
+		atomic.StoreInt32(&c.goaway, 0)
 		log.Infoln("Tunnel negotiated with gateway", msg[0], "successfully")
 		go c.startMultiplexer()
 	case evt_dt_closed:
+		if c.isClosed() {
+			break
+		}
+		if mlen > 0 {
+			if tun, y := msg[0].(*Conn); y && tun.isRetired() {
+				break
+			}
+		}
 		go c.startDataTun(mlen > 0)
 	case evt_st_msg:
 		if mlen == 1 {
@@ -147,48 +204,88 @@ func (c *Client) eventHandler(e event, msg ...interface{}) {
 			go c.commandHandler(msg[0].(byte), msg[1].([]byte))
 		}
 	case evt_st_active:
-		c.sigTun.active(msg[0].(int64))
+		c.getSigTun().active(msg[0].(int64))
 	}
 }
 
-func (c *Client) ClientServe(conn net.Conn) {
-	var done bool
-	defer func() {
-		ex.CatchException(recover())
-		if !done {
-			SafeClose(conn)
+func (c *Client) scaleLoop() {
+	var ticker = time.NewTicker(SCALE_INTERVAL)
+	defer ticker.Stop()
+	var mux = c.getMux()
+	for range ticker.C {
+		if mux.closing() {
+			return
 		}
-	}()
+		if atomic.LoadInt32(&c.State) == 0 {
+			c.scale(mux)
+		}
+	}
+}
 
-	pbConn := NewPushbackInputStream(conn)
-	switch detectProtocol(pbConn) {
-	case REQ_PROT_SOCKS5:
-		s5 := S5Step1{conn: pbConn}
-		s5.Handshake()
-		if !s5.HandshakeAck() {
-			literalTarget := s5.parseSocks5Request()
-			if !s5.respondSocks5() {
-				c.mux.HandleRequest("SOCKS5", conn, literalTarget)
-				done = true
-			}
+func (c *Client) scale(mux *multiplexer) {
+	add, idle := c.scaleOf(mux.pool.list())
+	if add {
+		go c.startDataTun(false)
+	} else if idle != nil {
+		go c.retireDataTun(mux, idle)
+	}
+}
+
+// add one tun if the tuns were busy, or retire an idle one,
+// the quantity will be kept in the range of server advertised.
+func (c *Client) scaleOf(tuns []*Conn) (add bool, idle *Conn) {
+	var (
+		n       = len(tuns)
+		streams int
+		traffic int64
+		free    *Conn
+	)
+	if n == 0 {
+		return
+	}
+	for _, tun := range tuns {
+		s, d := int(tun.activeStreams()), tun.trafficDelta()
+		streams += s
+		traffic += d
+		if s == 0 && d < SCALE_TRAFFIC_IDLE && free == nil {
+			free = tun
 		}
-	case REQ_PROT_HTTP:
-		prot, literalTarget := httpProxyHandshake(pbConn)
-		if prot == REQ_PROT_HTTP { // plain http
-			c.mux.HandleRequest("HTTP", pbConn, literalTarget)
-		} else { // http tunnel
-			c.mux.HandleRequest("HTTP/T", conn, literalTarget)
+	}
+	var (
+		dtCnt = int(atomic.LoadInt32(&c.dtCnt))
+		rate  = traffic / int64(n) / int64(SCALE_INTERVAL/time.Second)
+	)
+	switch {
+	case dtCnt < c.tp.tunMax && (streams > n*SCALE_STREAMS_HIGH || rate > SCALE_TRAFFIC_HIGH):
+		if log.V(2) {
+			log.Infof("Add DTun for load streams=%d rate=%s/s of %d tuns\n", streams, i64HumanSize(rate), n)
 		}
-		done = true
-	default:
-		log.Warningln("unrecognized request from", conn.RemoteAddr())
-		time.Sleep(REST_INTERVAL)
+		add = true
+	case dtCnt > c.tp.tunQty && free != nil && streams < (n-1)*SCALE_STREAMS_HIGH:
+		idle = free
 	}
+	return
+}
 
+// stop selecting the tun then close it if no stream was started in grace
+func (c *Client) retireDataTun(mux *multiplexer, tun *Conn) {
+	if !mux.pool.Remove(tun) {
+		return
+	}
+	time.Sleep(RETIRE_GRACE)
+	if tun.activeStreams() > 0 {
+		mux.pool.Push(tun)
+		return
+	}
+	if log.V(2) {
+		log.Infof("Retire idle DTun(%s)\n", tun.sign())
+	}
+	tun.retire()
+	SafeClose(tun)
 }
 
 func (t *Client) createDataTun() *Conn {
-	conn, err := net.DialTimeout("tcp", t.nego.d5sAddr.String(), GENERAL_SO_TIMEOUT)
+	conn, err := t.nego.dial()
 	ThrowErr(err)
 	buf := make([]byte, DMLEN2)
 	token := t.getToken()
@@ -199,14 +296,117 @@ func (t *Client) createDataTun() *Conn {
 	cipher := t.tp.cipherFactory.NewCipher(token)
 	_, err = conn.Write(buf)
 	ThrowErr(err)
-	c := NewConn(conn.(*net.TCPConn), cipher)
+	c := NewConn(conn, cipher)
 	c.identifier = t.nego.RemoteName()
+	c.features = t.tp.features
 	return c
 }
 
+// stop reconnecting and wait for the streams to finish then close the tuns,
+// the client should not be selected any longer.
+func (c *Client) Close() {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return
+	}
+	go func() {
+		if mux := c.getMux(); mux != nil {
+			if cut := mux.drain(DRAIN_TIMEOUT * time.Second); cut > 0 {
+				log.Warningf("Closing gateway %s, %d streams were cut\n", c.nego.RemoteName(), cut)
+			}
+		}
+		if st := c.getSigTun(); st != nil {
+			SafeClose(st.tun)
+		}
+		c.pendingSema.notifyAll()
+		log.Infoln("Gateway", c.nego.RemoteName(), "was closed")
+	}()
+}
+
+// apply the settings of d5p which has the same fingerprint, the connections
+// are kept and the new settings will be used by the later streams.
+func (c *Client) Reload(d5p *D5Params) {
+	var conf = d5p.backoff
+	if conf == nil {
+		conf, _ = parseBackoff(NULL)
+	}
+	c.stBackoff.configure(conf)
+	c.dtBackoff.configure(conf)
+	// serialized with startMultiplexer
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.settings.Store(d5p)
+	if c.mux != nil {
+		c.mux.configure(d5p.muxSettings())
+	}
+}
+
+// the tunable settings, the identity and endpoints are read from nego
+func (c *Client) params() *D5Params {
+	return c.settings.Load().(*D5Params)
+}
+
+// the mux was created by the first sigTun, and read by the others
+func (c *Client) getMux() *multiplexer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.mux
+}
+
+// the sigTun is replaced by reconnecting
+func (c *Client) getSigTun() *signalTunnel {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.sigTun
+}
+
+func (c *Client) isClosed() bool {
+	return atomic.LoadInt32(&c.closed) > 0
+}
+
+// the gateway asked for opening new streams elsewhere
+func (c *Client) Draining() bool {
+	return atomic.LoadInt32(&c.goaway) > 0
+}
+
+// HEALTH_HEALTHY, HEALTH_DEGRADED or HEALTH_UNHEALTHY by probing
+func (c *Client) Health() int {
+	return c.health.getStatus()
+}
+
+func (c *Client) Weight() int {
+	return c.params().weight
+}
+
+// active streams of all tuns
+func (c *Client) ActiveStreams() (n int) {
+	if mux := c.getMux(); mux != nil {
+		for _, tun := range mux.pool.list() {
+			n += int(tun.activeStreams())
+		}
+	}
+	return
+}
+
+// the lowest rtt of tuns
+func (c *Client) RTT() (min time.Duration) {
+	min = RTT_UNKNOWN
+	if mux := c.getMux(); mux != nil {
+		for _, tun := range mux.pool.list() {
+			if rtt := tun.RTT(); rtt > 0 && rtt < min {
+				min = rtt
+			}
+		}
+	}
+	return
+}
+
 func (t *Client) Stats() string {
-	return fmt.Sprintf("Stats/Client -> %s DT=%d TK=%d", t.nego.d5sAddrStr,
-		atomic.LoadInt32(&t.dtCnt), len(t.token)/TKSZ)
+	var saved int64
+	if mux := t.getMux(); mux != nil {
+		saved = atomic.LoadInt64(&mux.saved)
+	}
+	return fmt.Sprintf("Stats/Client -> %s DT=%d TK=%d Saved=%s Health=%s Breaker=%s", t.nego.d5sAddrStr,
+		atomic.LoadInt32(&t.dtCnt), len(t.token)/TKSZ, i64HumanSize(saved), t.health, t.stBackoff)
 }
 
 func (c *Client) getToken() []byte {
@@ -219,7 +419,7 @@ func (c *Client) getToken() []byte {
 			if log.V(4) {
 				log.Infof("Request new tokens, pool=%d\n", tlen)
 			}
-			c.sigTun.postCommand(TOKEN_REQUEST, nil)
+			c.getSigTun().postCommand(TOKEN_REQUEST, nil)
 		}
 	}()
 	for len(c.token) < TKSZ {
@@ -256,7 +456,39 @@ func (c *Client) commandHandler(cmd byte, args []byte) {
 	switch cmd {
 	case TOKEN_REPLY:
 		c.putTokens(args)
+	case CTL_GOAWAY:
+		atomic.StoreInt32(&c.goaway, 1)
+		log.Warningf("Gateway %s is draining, the new requests will go elsewhere\n", c.nego.RemoteName())
 	default:
 		log.Warningf("Unrecognized command=%x packet=[% x]\n", cmd, args)
 	}
 }
+
+// match the clients to the list by fingerprint in order, the matched are
+// reloaded in place, and the rest of list will be the new clients which are
+// not started yet.
+func MatchClients(clients []*Client, list []*D5Params, dhKeys *DHKeyPair) (matched, added, removed []*Client) {
+	var old = make(map[string][]*Client)
+	for _, c := range clients {
+		fp := c.nego.Fingerprint()
+		old[fp] = append(old[fp], c)
+	}
+	matched = make([]*Client, len(list))
+	for i, d5p := range list {
+		fp := d5p.Fingerprint()
+		if kept := old[fp]; len(kept) > 0 {
+			matched[i], old[fp] = kept[0], kept[1:]
+			matched[i].Reload(d5p)
+		} else {
+			matched[i] = NewClient(d5p, dhKeys)
+			added = append(added, matched[i])
+		}
+	}
+	for _, c := range clients {
+		fp := c.nego.Fingerprint()
+		if kept := old[fp]; len(kept) > 0 && kept[0] == c {
+			removed, old[fp] = append(removed, c), kept[1:]
+		}
+	}
+	return
+}
@@ -0,0 +1,109 @@
+package tunnel
+
+import (
+	"bytes"
+	"compress/flate"
+	"github.com/spance/deblocus/exception"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+const (
+	// flag on the action of DATA frame, the payload was deflated
+	FRAME_FLAG_COMPRESSED = 0x80
+	// too small to compress
+	COMPRESS_MIN_SIZE = 128
+	// the compressed must be smaller than 7/8 of original
+	COMPRESS_RATIO_SHIFT = 3
+	// bypass frames after the incompressible were sampled, doubling to max
+	COMPRESS_BYPASS_MIN = 4
+	COMPRESS_BYPASS_MAX = 256
+)
+
+var (
+	BAD_COMPRESSED_DATA = exception.NewW("Bad compressed data")
+)
+
+var (
+	flateWriters = sync.Pool{
+		New: func() interface{} {
+			w, _ := flate.NewWriter(nil, flate.BestSpeed)
+			return w
+		},
+	}
+	flateReaders = sync.Pool{
+		New: func() interface{} {
+			return flate.NewReader(nil)
+		},
+	}
+)
+
+// per stream compression sampler, the frames are compressed independently
+// and the incompressible stream will be bypassed for a while.
+// only raw deflate (RFC 1951) is defined for FEATURE_COMPRESS, there is no
+// algorithm negotiation. The compressed length leaks information about the
+// plaintext, so it's disabled by default against CRIME/BREACH like attacks
+// when the secrets share a stream with the attacker controlled data.
+type compressor struct {
+	bypass  int // the remaining frames to bypass
+	penalty int
+}
+
+// compress src into dst, returns 0 if not worth.
+func (c *compressor) compress(dst, src []byte) int {
+	if len(src) < COMPRESS_MIN_SIZE {
+		return 0
+	}
+	if c.bypass > 0 {
+		c.bypass--
+		return 0
+	}
+	var (
+		max = len(src) - len(src)>>COMPRESS_RATIO_SHIFT
+		out = &fixedWriter{buf: dst[:0:max]}
+		w   = flateWriters.Get().(*flate.Writer)
+	)
+	w.Reset(out)
+	_, err := w.Write(src)
+	if err == nil {
+		err = w.Close()
+	}
+	flateWriters.Put(w)
+	if err != nil { // incompressible
+		if c.penalty < COMPRESS_BYPASS_MIN {
+			c.penalty = COMPRESS_BYPASS_MIN
+		} else if c.penalty < COMPRESS_BYPASS_MAX {
+			c.penalty <<= 1
+		}
+		c.bypass = c.penalty
+		return 0
+	}
+	c.penalty = 0
+	return len(out.buf)
+}
+
+func inflate(src []byte) ([]byte, error) {
+	r := flateReaders.Get().(io.ReadCloser)
+	defer flateReaders.Put(r)
+	r.(flate.Resetter).Reset(bytes.NewReader(src), nil)
+	// the original was a frame
+	data, err := ioutil.ReadAll(io.LimitReader(r, FRAME_MAX_LEN+1))
+	if err != nil || len(data) > FRAME_MAX_LEN {
+		return nil, BAD_COMPRESSED_DATA.Apply(err)
+	}
+	return data, nil
+}
+
+// writer to the buffer will be failed when reaching its capacity
+type fixedWriter struct {
+	buf []byte
+}
+
+func (w *fixedWriter) Write(b []byte) (int, error) {
+	if len(w.buf)+len(b) > cap(w.buf) {
+		return 0, io.ErrShortWrite
+	}
+	w.buf = append(w.buf, b...)
+	return len(b), nil
+}
@@ -0,0 +1,119 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_compressor(t *testing.T) {
+	var (
+		c    = new(compressor)
+		dst  = make([]byte, FRAME_MAX_LEN)
+		text = bytes.Repeat([]byte("GET /index.html HTTP/1.1\r\nHost: example.com\r\n"), 100)
+	)
+	n := c.compress(dst, text)
+	if n <= 0 || n >= len(text) {
+		t.Fatalf("compressed %d -> %d", len(text), n)
+	}
+	data, e := inflate(dst[:n])
+	if e != nil || !bytes.Equal(data, text) {
+		t.Fatalf("inflate %v", e)
+	}
+	// incompressible then bypass
+	random := make([]byte, 4096)
+	rand.Read(random)
+	if c.compress(dst, random) != 0 || c.bypass != COMPRESS_BYPASS_MIN {
+		t.Fatalf("incompressible bypass=%d", c.bypass)
+	}
+	for i := 0; i < COMPRESS_BYPASS_MIN; i++ {
+		if c.compress(dst, text) != 0 {
+			t.Fatalf("not bypassed")
+		}
+	}
+	if c.compress(dst, text) == 0 {
+		t.Fatalf("not sampled again")
+	}
+	if _, e = inflate(random); e == nil {
+		t.Fatalf("inflated the garbage")
+	}
+}
+
+func Test_compressedStream(t *testing.T) {
+	echo := listenLocal(t, func(conn net.Conn) {
+		io.Copy(conn, conn)
+		conn.Close()
+	})
+	defer echo.Close()
+	var (
+		svr = NewServerMultiplexer()
+		clt = NewClientMultiplexer()
+	)
+	defer svr.router.stopCleanTask()
+	defer clt.router.stopCleanTask()
+	svrLn := listenLocal(t, func(conn net.Conn) {
+		svr.Listen(newTestConn(conn), nil, 0)
+	})
+	defer svrLn.Close()
+	conn, e := net.Dial("tcp", svrLn.Addr().String())
+	if e != nil {
+		t.Fatal(e)
+	}
+	go clt.Listen(newTestConn(conn), nil, 0)
+	for clt.pool.Len() < 1 {
+		rest(-1)
+	}
+	front := listenLocal(t, func(conn net.Conn) {
+		clt.HandleRequest("T", conn, echo.Addr().String())
+	})
+	defer front.Close()
+	if conn, e = net.Dial("tcp", front.Addr().String()); e != nil {
+		t.Fatal(e)
+	}
+	defer conn.Close()
+	var (
+		text = bytes.Repeat([]byte("GET /index.html HTTP/1.1\r\nHost: example.com\r\n"), 1000)
+		recv = make([]byte, len(text))
+	)
+	go conn.Write(text)
+	if _, e = io.ReadFull(conn, recv); e != nil {
+		t.Fatal(e)
+	}
+	if !bytes.Equal(text, recv) {
+		t.Fatalf("inconsistent after compression")
+	}
+	if c, s := atomic.LoadInt64(&clt.saved), atomic.LoadInt64(&svr.saved); c <= 0 || s <= 0 {
+		t.Fatalf("compression saved client=%d server=%d", c, s)
+	}
+}
+
+func Test_compressedUnnegotiated(t *testing.T) {
+	var (
+		svr      = NewServerMultiplexer()
+		abandons = make(chan bool, 1)
+		ln       = listenLocal(t, func(conn net.Conn) {
+			// featureless
+			svr.Listen(NewConn(conn.(*net.TCPConn), nil), nil, 0)
+			abandons <- true
+		})
+	)
+	defer svr.router.stopCleanTask()
+	defer ln.Close()
+	conn, e := net.Dial("tcp", ln.Addr().String())
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer conn.Close()
+	var buf = make([]byte, FRAME_HEADER_LEN+4)
+	_frame(buf, FRAME_HEADER_LEN, FRAME_ACTION_DATA|FRAME_FLAG_COMPRESSED, 1, []byte("data"))
+	conn.Write(buf)
+	select {
+	case <-abandons:
+	case <-time.After(time.Second * 2):
+		t.Fatalf("the tun was not abandoned")
+	}
+}
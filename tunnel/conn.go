@@ -6,31 +6,48 @@ import (
 	"hash"
 	"net"
 	"sync"
+	"sync/atomic"
 	//"syscall"
 	"time"
 	//"unsafe"
 )
 
 type Conn struct {
+	queued      int64 // bytes delivered to equeues, atomic and keep 64-bit aligned
+	rtt         int64 // smoothed rtt in nanoseconds
+	traffic     int64 // bytes read and written
+	lastTraffic int64 // traffic at last scaling check
+	streams     int32 // active streams
+	retired     int32 // closed for scaling down, needn't reconnect
 	net.Conn
 	cipher     *Cipher
 	identifier string
+	uid        string // owner of tun in server side
+	features   uint16 // negotiated protocol features
+	sidSeq     uint32 // last allocated sid, guarded by router
+	obfs       *obfuscator
 	wlock      sync.Locker
-	priority   *TSPriority
+	sched      *writeScheduler // turns of the frame writers
+	drained    chan bool
 }
 
 func NewConn(conn *net.TCPConn, cipher *Cipher) *Conn {
 	return &Conn{
-		Conn:   conn,
-		cipher: cipher,
-		wlock:  new(sync.Mutex),
+		Conn:    conn,
+		cipher:  cipher,
+		wlock:   new(sync.Mutex),
+		sched:   newWriteScheduler(),
+		drained: make(chan bool, 1),
 	}
 }
 
 func (c *Conn) Read(b []byte) (int, error) {
 	n, err := c.Conn.Read(b)
-	if n > 0 && c.cipher != nil {
-		c.cipher.decrypt(b[:n], b[:n])
+	if n > 0 {
+		atomic.AddInt64(&c.traffic, int64(n))
+		if c.cipher != nil {
+			c.cipher.decrypt(b[:n], b[:n])
+		}
 	}
 	return n, err
 }
@@ -41,7 +58,9 @@ func (c *Conn) Write(b []byte) (int, error) {
 	if c.cipher != nil {
 		c.cipher.encrypt(b, b)
 	}
-	return c.Conn.Write(b)
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.traffic, int64(n))
+	return n, err
 }
 
 func (c *Conn) Close() error {
@@ -77,18 +96,61 @@ func (c *Conn) SetSockOpt(disableDeadline, keepAlive, noDelay int8) {
 	}
 }
 
-func (c *Conn) Update() {
-	n := time.Now().UnixNano()
-	if d := n - c.priority.last; d < 1e9 {
-		if d <= 0 {
-			c.priority.rank -= 1e9
-		} else {
-			c.priority.rank -= 1e9 / d
-		}
+// srtt = 7/8 srtt + 1/8 sample
+func (c *Conn) updateRTT(sample time.Duration) {
+	var srtt = atomic.LoadInt64(&c.rtt)
+	if srtt == 0 {
+		srtt = int64(sample)
 	} else {
-		c.priority.rank = 1e9
+		srtt = (7*srtt + int64(sample)) >> 3
+	}
+	atomic.StoreInt64(&c.rtt, srtt)
+}
+
+func (c *Conn) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.rtt))
+}
+
+func (c *Conn) activeStreams() int32 {
+	return atomic.LoadInt32(&c.streams)
+}
+
+func (c *Conn) queuedBytes() int64 {
+	return atomic.LoadInt64(&c.queued)
+}
+
+// the traffic since last calling
+func (c *Conn) trafficDelta() int64 {
+	total := atomic.LoadInt64(&c.traffic)
+	return total - atomic.SwapInt64(&c.lastTraffic, total)
+}
+
+func (c *Conn) retire() {
+	atomic.StoreInt32(&c.retired, 1)
+}
+
+func (c *Conn) isRetired() bool {
+	return atomic.LoadInt32(&c.retired) > 0
+}
+
+func (c *Conn) headerLen() int {
+	if c.features&FEATURE_SID32 != 0 {
+		return FRAME_HEADER_LEN32
+	}
+	return FRAME_HEADER_LEN
+}
+
+func (c *Conn) enqueued(n int) {
+	atomic.AddInt64(&c.queued, int64(n))
+}
+
+// wakeup the paused reader of tun
+func (c *Conn) dequeued(n int) {
+	atomic.AddInt64(&c.queued, -int64(n))
+	select {
+	case c.drained <- true:
+	default:
 	}
-	c.priority.last = n
 }
 
 func (c *Conn) sign() string {
@@ -121,7 +183,7 @@ type hashedConn struct {
 
 func NewConnWithHash(conn *net.TCPConn) *hashedConn {
 	return &hashedConn{
-		Conn:  &Conn{Conn: conn, wlock: new(sync.Mutex)},
+		Conn:  &Conn{Conn: conn, wlock: new(sync.Mutex), sched: newWriteScheduler()},
 		rHash: sha1.New(),
 		wHash: sha1.New(),
 	}
@@ -161,9 +223,7 @@ func (c *hashedConn) WHashSum() []byte {
 	return hash
 }
 
-//
 // PushbackInputStream
-//
 type pushbackInputStream struct {
 	net.Conn
 	buffer []byte
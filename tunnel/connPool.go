@@ -2,29 +2,38 @@ package tunnel
 
 import (
 	log "github.com/spance/deblocus/golang/glog"
-	"sort"
 	"sync"
+	"time"
 )
 
-type TSPriority struct {
-	last int64
-	rank int64
+const (
+	// assumed rtt of the tun has not been measured
+	RTT_UNKNOWN = 100 * time.Millisecond
+)
+
+// SelectStrategy chooses the tun for new stream from the non-empty pool.
+type SelectStrategy interface {
+	Select(pool []*Conn) *Conn
 }
 
 type ConnPool struct {
-	pool sortableConns
-	lock sync.Locker
+	pool     []*Conn
+	lock     sync.Locker
+	strategy SelectStrategy
 }
 
 func NewConnPool() *ConnPool {
-	return &ConnPool{lock: new(sync.Mutex)}
+	return &ConnPool{
+		lock:     new(sync.Mutex),
+		strategy: new(LeastCostStrategy),
+	}
 }
 
-type sortableConns []*Conn
-
-func (h sortableConns) Len() int           { return len(h) }
-func (h sortableConns) Less(i, j int) bool { return h[i].priority.rank > h[j].priority.rank } // reverse
-func (h sortableConns) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *ConnPool) SetStrategy(s SelectStrategy) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.strategy = s
+}
 
 func (h *ConnPool) Push(x *Conn) {
 	h.lock.Lock()
@@ -38,7 +47,7 @@ func (h *ConnPool) Remove(c *Conn) bool {
 	var (
 		i int
 		x int = -1
-		n     = h.pool.Len()
+		n     = len(h.pool)
 	)
 	for i = 0; i < n; i++ {
 		if h.pool[i] == c {
@@ -61,21 +70,29 @@ func (h *ConnPool) Remove(c *Conn) bool {
 }
 
 func (h *ConnPool) Len() int {
-	return h.pool.Len()
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return len(h.pool)
+}
+
+// a copy of pooled tuns
+func (h *ConnPool) list() []*Conn {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return append([]*Conn(nil), h.pool...)
 }
 
 func (h *ConnPool) Select() *Conn {
 	h.lock.Lock()
 	defer h.lock.Unlock()
-	if h.pool.Len() < 1 {
+	if len(h.pool) < 1 {
 		return nil
 	}
-	sort.Sort(h.pool)
+	selected := h.strategy.Select(h.pool)
 	if log.V(5) {
-		log.Infoln("selected tun", h.pool[0].LocalAddr())
+		log.Infof("selected tun %s rtt=%s streams=%d queued=%d\n", selected.LocalAddr(),
+			selected.RTT(), selected.activeStreams(), selected.queuedBytes())
 	}
-	selected := h.pool[0]
-	selected.priority.rank -= 1
 	return selected
 }
 
@@ -87,3 +104,45 @@ func (h *ConnPool) destroy() {
 	}
 	h.pool = nil
 }
+
+// LeastCostStrategy prefers the tun having lower rtt, less active streams
+// and queued bytes, the equal ones will be chosen in turn.
+type LeastCostStrategy struct {
+	next int
+}
+
+func (s *LeastCostStrategy) Select(pool []*Conn) *Conn {
+	var (
+		selected *Conn
+		min      float64
+		n        = len(pool)
+	)
+	for i := 0; i < n; i++ {
+		c := pool[(s.next+i)%n]
+		if cost := c.cost(); selected == nil || cost < min {
+			selected, min = c, cost
+		}
+	}
+	s.next++
+	return selected
+}
+
+type RoundRobinStrategy struct {
+	next int
+}
+
+func (s *RoundRobinStrategy) Select(pool []*Conn) *Conn {
+	s.next++
+	return pool[s.next%len(pool)]
+}
+
+// estimated cost of new stream on the tun
+func (c *Conn) cost() float64 {
+	rtt := c.RTT()
+	if rtt <= 0 {
+		rtt = RTT_UNKNOWN
+	}
+	load := float64(1 + c.activeStreams())
+	queued := 1 + float64(c.queuedBytes())/EQUEUE_LIMIT
+	return float64(rtt) * load * queued
+}
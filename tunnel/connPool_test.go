@@ -4,6 +4,7 @@ import (
 	"container/list"
 	"math/rand"
 	"testing"
+	"time"
 )
 
 var (
@@ -24,7 +25,7 @@ func Test_add_remove(t *testing.T) {
 		tmp.PushBack(c)
 		pool.Push(c)
 	}
-	if l := pool.pool.Len(); l != n {
+	if l := pool.Len(); l != n {
 		t.Error("after push len=", l)
 	}
 	for e := tmp.Front(); e != nil; e = e.Next() {
@@ -32,7 +33,7 @@ func Test_add_remove(t *testing.T) {
 			t.Error("remove failed")
 		}
 	}
-	if l := pool.pool.Len(); l != 0 {
+	if l := pool.Len(); l != 0 {
 		t.Error("after remove len=", l)
 	}
 }
@@ -44,15 +45,23 @@ func Test_priority(t *testing.T) {
 		pool.Push(NewConn(nil, nil))
 	}
 	for i := 0; i < n; i++ {
-		p := &TSPriority{1, int64(i)}
-		pool.pool[i].priority = p
+		// the last has the lowest rtt but more streams
+		pool.pool[i].updateRTT(time.Duration(n-i) * time.Millisecond)
 	}
+	pool.pool[n-1].streams = 3
 	c := pool.Select()
-	if c.priority.rank == int64(n-2) {
-		t.Logf("select successfully priority=%v", c.priority)
+	if c == pool.pool[n-2] {
+		t.Logf("select successfully rtt=%s", c.RTT())
 	} else {
-		t.Errorf("select failed priority=%v", c.priority)
+		t.Errorf("select failed rtt=%s streams=%d", c.RTT(), c.streams)
 	}
+	// the equal ones in turn
+	rr := &RoundRobinStrategy{}
+	pool.SetStrategy(rr)
+	if pool.Select() == pool.Select() {
+		t.Errorf("round-robin selected the same")
+	}
+	pool.SetStrategy(new(LeastCostStrategy))
 }
 
 func randn(m int) int {
@@ -35,9 +35,23 @@ const (
 	REQ_PROT_SOCKS5     = 2
 	REQ_PROT_HTTP       = 3
 	REQ_PROT_HTTP_T     = 4
+	REQ_PROT_LOCAL      = 5
+	REQ_PROT_LOCAL_HEAD = 6
 	CRLF                = "\r\n"
 	HTTP_PROXY_VER_LINE = "HTTP/1.1 200 Connection established"
 	HTTP_PROXY_AGENT    = "Proxy-Agent: deblocus"
+
+	// protocol features negotiated by both sides
+	FEATURE_FLOW_CONTROL = 1 << 0
+	FEATURE_SID32        = 1 << 1 // 32-bit sid in frame header
+	FEATURE_RESUME       = 1 << 2 // resumable streams, requires flow control
+	FEATURE_TUN_SCALING  = 1 << 3 // tunMax in tun params
+	FEATURE_COMPRESS     = 1 << 4 // raw deflate DATA frames, another algorithm needs a new bit
+	FEATURE_PADDING      = 1 << 5 // understanding PADDING frames
+	FEATURE_PRIORITY     = 1 << 6 // priority class before dest in OPEN frame
+	LOCAL_FEATURES       = FEATURE_FLOW_CONTROL | FEATURE_SID32 | FEATURE_RESUME | FEATURE_TUN_SCALING | FEATURE_COMPRESS | FEATURE_PADDING | FEATURE_PRIORITY
+	// the remote version since features could be negotiated, 0.9.2240
+	FEATURES_SINCE_VER = 0x000908c0
 )
 
 var (
@@ -267,13 +281,20 @@ func httpProxyHandshake(conn *pushbackInputStream) (req_prot uint, target string
 	if err != nil {
 		panic(err)
 	}
+	// not a proxy request, the user agent is requesting local resource.
+	if req.Method != "CONNECT" && !req.URL.IsAbs() {
+		switch req.Method {
+		case "GET":
+			return REQ_PROT_LOCAL, req.URL.Path
+		case "HEAD":
+			return REQ_PROT_LOCAL_HEAD, req.URL.Path
+		}
+		respondHttp(conn, "405 Method Not Allowed", NULL, nil, false)
+		return REQ_PROT_UNKNOWN, NULL
+	}
 	// http tunnel, direct into tunnel
-	if req.Method == "CONNECT" { // respond OK then enter into tunnel
+	if req.Method == "CONNECT" { // should respond OK then enter into tunnel
 		req_prot = REQ_PROT_HTTP_T
-		conn.WriteString(HTTP_PROXY_VER_LINE)
-		conn.WriteString(CRLF)
-		conn.WriteString(HTTP_PROXY_AGENT + "/" + VER_STRING)
-		conn.WriteString(CRLF + CRLF)
 		target = req.Host
 	} else { // plain http request
 		req_prot = REQ_PROT_HTTP
@@ -302,6 +323,29 @@ func httpProxyHandshake(conn *pushbackInputStream) (req_prot uint, target string
 	return
 }
 
+func respondHttpTunnel(conn *pushbackInputStream) {
+	conn.WriteString(HTTP_PROXY_VER_LINE)
+	conn.WriteString(CRLF)
+	conn.WriteString(HTTP_PROXY_AGENT + "/" + VER_STRING)
+	conn.WriteString(CRLF + CRLF)
+}
+
+// respond then close, the text status is the body if absent
+func respondHttp(conn net.Conn, status, contentType string, body []byte, head bool) {
+	if contentType == NULL {
+		contentType, body = "text/plain", []byte(status)
+	}
+	buf := new(bytes.Buffer)
+	buf.WriteString("HTTP/1.1 " + status + CRLF)
+	buf.WriteString("Content-Type: " + contentType + CRLF)
+	fmt.Fprintf(buf, "Content-Length: %d%s", len(body), CRLF)
+	buf.WriteString("Connection: close" + CRLF + CRLF)
+	if !head {
+		buf.Write(body)
+	}
+	conn.Write(buf.Bytes())
+}
+
 func hash20(byteArray []byte) []byte {
 	sha := sha1.New()
 	sha.Write(byteArray)
@@ -332,7 +376,9 @@ type tunParams struct {
 	token         []byte
 	stInterval    int
 	dtInterval    int
-	tunQty        int
+	tunQty        int // the min if scaling
+	tunMax        int
+	features      uint16
 }
 
 //
@@ -345,8 +391,10 @@ type d5CNegotiation struct {
 }
 
 func (nego *d5CNegotiation) negotiate() (*Conn, *tunParams) {
-	conn, err := net.DialTCP("tcp", nil, nego.d5sAddr)
-	ThrowIf(err != nil, D5SER_UNREACHABLE)
+	conn, err := nego.dial()
+	if err != nil {
+		panic(D5SER_UNREACHABLE.Apply(err))
+	}
 	setSoTimeout(conn)
 	var sconn = NewConnWithHash(conn)
 	err = nego.requestAuthAndDHExchange(sconn)
@@ -368,8 +416,9 @@ func (nego *d5CNegotiation) requestAuthAndDHExchange(conn *hashedConn) (err erro
 	obf[0xff] = d5Sub(obf[0xd5])
 	// send identity using rsa
 	// identity must be less than 117byte for once encrypting
+	// user\x00pass\x00version~8 features~4
 	idBlock := make([]byte, 128)
-	identity := fmt.Sprintf("%s\x00%s", nego.user, nego.pass)
+	identity := fmt.Sprintf("%s\x00%s\x00%08x%04x", nego.user, nego.pass, VERSION, LOCAL_FEATURES)
 	idBlock, err = RSAEncrypt([]byte(identity), nego.sPub)
 
 	buf := new(bytes.Buffer)
@@ -410,6 +459,7 @@ func (nego *d5CNegotiation) validateAndGetTokens(sconn *hashedConn, t *tunParams
 	ThrowErr(err)
 	tVer := VERSION
 	oVer := binary.BigEndian.Uint32(buf)
+	rVer := oVer
 	if oVer > tVer {
 		oVerStr := fmt.Sprintf("%d.%d.%04d", oVer>>24, (oVer>>16)&0xFF, oVer&0xFFFF)
 		tVer >>= 16
@@ -426,6 +476,17 @@ func (nego *d5CNegotiation) validateAndGetTokens(sconn *hashedConn, t *tunParams
 	t.dtInterval = int(binary.BigEndian.Uint16(buf[ofs:]))
 	ofs += 2
 	t.tunQty = int(buf[ofs])
+	ofs++
+	// older server filled random bytes
+	if rVer >= FEATURES_SINCE_VER {
+		t.features = binary.BigEndian.Uint16(buf[ofs:]) & LOCAL_FEATURES
+	}
+	ofs += 2
+	t.tunMax = t.tunQty
+	if t.features&FEATURE_TUN_SCALING != 0 && int(buf[ofs]) > t.tunQty {
+		t.tunMax = int(buf[ofs])
+	}
+	ofs++
 	t.token = buf[TUN_PARAMS_LEN:]
 	if log.V(2) {
 		n := len(buf) - TUN_PARAMS_LEN
@@ -451,8 +512,10 @@ func (nego *d5CNegotiation) validateAndGetTokens(sconn *hashedConn, t *tunParams
 //
 type d5SNegotiation struct {
 	*Server
+	*D5ServConf    // snapshot of the negotiation
 	clientAddr     string
 	clientIdentity string
+	clientFeatures uint16
 	tokenBuf       []byte
 }
 
@@ -481,6 +544,12 @@ func (nego *d5SNegotiation) negotiate(hconn *hashedConn) (session *Session, err
 		cf = NewCipherFactory(nego.Algo, skey)
 		hconn.cipher = cf.NewCipher(nil)
 		session = NewSession(hconn.Conn, cf, nego.clientIdentity)
+		// the DT may arrive with the tokens before the ST was established
+		session.svr = nego.Server
+		session.features = nego.clientFeatures & LOCAL_FEATURES
+		if !nego.Compress {
+			session.features &^= FEATURE_COMPRESS
+		}
 		err = nego.respondTestWithToken(hconn, session)
 		return
 	}
@@ -513,6 +582,7 @@ func (nego *d5SNegotiation) verifyThenDHExchange(conn net.Conn, credBuf []byte)
 		return nil, ex
 	}
 	nego.clientIdentity = clientIdentity
+	nego.clientFeatures = parseClientFeatures(clientIdentity)
 	key = takeSharedKey(nego.dhKeys, cDHPub)
 	//	if log.V(5) {
 	//		dumpHex("Sharedkey", key)
@@ -524,8 +594,21 @@ func (nego *d5SNegotiation) verifyThenDHExchange(conn net.Conn, credBuf []byte)
 	return
 }
 
-//         |------------- tun params ------------|
-// | len~2 | version~4 | interval~2 | reserved~? | tokens~20N ; hash~20
+// the older client has not this part
+func parseClientFeatures(identity string) uint16 {
+	fields := strings.Split(identity, "\x00")
+	if len(fields) < 3 || len(fields[2]) != 12 {
+		return 0
+	}
+	features, e := strconv.ParseUint(fields[2][8:], 16, 16)
+	if e != nil {
+		return 0
+	}
+	return uint16(features)
+}
+
+//         |--------------------------------------- tun params ---------------------------------------|
+// | len~2 | version~4 | stInterval~2 | dtInterval~2 | tunQty~1 | features~2 | tunMax~1 | reserved~? | tokens~20N ; hash~20
 func (nego *d5SNegotiation) respondTestWithToken(sconn *hashedConn, session *Session) (err error) {
 	var headLen = TUN_PARAMS_LEN + 2
 	// tun params
@@ -538,7 +621,11 @@ func (nego *d5SNegotiation) respondTestWithToken(sconn *hashedConn, session *Ses
 	ofs += 2
 	binary.BigEndian.PutUint16(tpBuf[ofs:], uint16(DT_PING_INTERVAL))
 	ofs += 2
-	tpBuf[ofs] = PARALLEL_TUN_QTY
+	tpBuf[ofs] = byte(nego.MinTunnels)
+	ofs++
+	binary.BigEndian.PutUint16(tpBuf[ofs:], session.features)
+	ofs += 2
+	tpBuf[ofs] = byte(nego.MaxTunnels)
 
 	_, err = sconn.Write(tpBuf)
 	ThrowErr(err)
@@ -2,7 +2,10 @@ package tunnel
 
 import (
 	"crypto/rand"
+	"crypto/rsa"
 	"io"
+	"net"
+	"sync/atomic"
 	"testing"
 )
 
@@ -18,3 +21,102 @@ func TestD5Code(t *testing.T) {
 		}
 	}
 }
+
+func testRSAKeys(t *testing.T) *RSAKeyPair {
+	// the size doesn't matter here
+	priv, e := rsa.GenerateKey(rand.Reader, 512)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return &RSAKeyPair{priv, &priv.PublicKey}
+}
+
+func Test_serverReload(t *testing.T) {
+	var (
+		keys = testRSAKeys(t)
+		svr  = NewServer(&D5ServConf{Listen: ":9008", RSAKeys: keys, MaxTunnels: 8, queueLimit: 1}, nil)
+		done = make(chan bool)
+	)
+	defer svr.mux.router.stopCleanTask()
+	// the readers of the sessions and streams
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			if svr.conf().MaxTunnels < 1 || svr.mux.conf().queueLimit < 1 {
+				t.Errorf("invalid settings")
+			}
+		}
+	}()
+	svr.Reload(&D5ServConf{Listen: ":9009", RSAKeys: testRSAKeys(t), MaxTunnels: 4, queueLimit: 2})
+	<-done
+	d5s := svr.conf()
+	if d5s.Listen != ":9008" || d5s.RSAKeys != keys {
+		t.Errorf("Listen=%s or key was changed", d5s.Listen)
+	}
+	if d5s.MaxTunnels != 4 || svr.mux.conf().queueLimit != 2 {
+		t.Errorf("MaxTunnels=%d queueLimit=%d", d5s.MaxTunnels, svr.mux.conf().queueLimit)
+	}
+}
+
+func Test_clientScale(t *testing.T) {
+	var (
+		c          = &Client{tp: &tunParams{tunQty: 1, tunMax: 3}}
+		busy, free = NewConn(nil, nil), NewConn(nil, nil)
+	)
+	busy.streams = SCALE_STREAMS_HIGH + 1
+	c.dtCnt = 1
+	if add, idle := c.scaleOf([]*Conn{busy}); !add || idle != nil {
+		t.Fatalf("not scaled up add=%v idle=%v", add, idle)
+	}
+	c.dtCnt = 3 // tunMax
+	if add, _ := c.scaleOf([]*Conn{busy, free, free}); add {
+		t.Fatalf("scaled up over the max")
+	}
+	// retire the one without stream and traffic
+	busy.streams, c.dtCnt = 1, 2
+	free.traffic = SCALE_TRAFFIC_IDLE * 2
+	if _, idle := c.scaleOf([]*Conn{busy, free}); idle != nil {
+		t.Fatalf("retired the tun having traffic")
+	}
+	if add, idle := c.scaleOf([]*Conn{busy, free}); add || idle != free {
+		t.Fatalf("not scaled down add=%v idle=%v", add, idle)
+	}
+	c.dtCnt = 1 // tunQty
+	if _, idle := c.scaleOf([]*Conn{busy, free}); idle != nil {
+		t.Fatalf("scaled down under the quantity")
+	}
+	var (
+		mux  = NewClientMultiplexer()
+		w, r = net.Pipe()
+	)
+	defer mux.router.stopCleanTask()
+	free.Conn = w
+	mux.pool.Push(busy)
+	mux.pool.Push(free)
+	c.retireDataTun(mux, free)
+	if !free.isRetired() || mux.pool.Len() != 1 {
+		t.Fatalf("retired=%v pool=%d", free.isRetired(), mux.pool.Len())
+	}
+	if _, e := r.Read(make([]byte, 1)); e != io.EOF {
+		t.Fatalf("the retired was not closed %v", e)
+	}
+}
+
+func Test_sessionMaxTunnels(t *testing.T) {
+	var (
+		svr  = NewServer(&D5ServConf{Listen: ":9008", RSAKeys: testRSAKeys(t), MaxTunnels: 1}, nil)
+		s    = NewSession(nil, nil, "u")
+		fc   = NewConn(nil, nil)
+		w, r = net.Pipe()
+	)
+	defer svr.mux.router.stopCleanTask()
+	s.svr, s.dtCnt, fc.Conn = svr, 1, w
+	// refused before serving
+	s.DataTunServe(fc, nil)
+	if _, e := r.Read(make([]byte, 1)); e != io.EOF {
+		t.Fatalf("the exceeded was not closed %v", e)
+	}
+	if n := atomic.LoadInt32(&s.dtCnt); n != 1 || atomic.LoadInt32(&svr.dtCnt) != 0 {
+		t.Fatalf("session dtCnt=%d server dtCnt=%d", n, svr.dtCnt)
+	}
+}
@@ -0,0 +1,101 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+const (
+	// rfc8305 connection attempt delay
+	HE_ATTEMPT_DELAY = 250 * time.Millisecond
+)
+
+// interleave the address families, the first family of the list will be kept.
+func sortByFamily(ips []net.IP) []net.IP {
+	var v4, v6, sorted []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	first, second := v6, v4
+	if len(ips) > 0 && ips[0].To4() != nil {
+		first, second = v4, v6
+	}
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			sorted = append(sorted, first[i])
+		}
+		if i < len(second) {
+			sorted = append(sorted, second[i])
+		}
+	}
+	return sorted
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// Happy Eyeballs: the next attempt will be started if the previous attempt
+// failed or not finished in the attempt delay, and the first succeeded wins.
+// localAddr returns the source address for the ip, nil for default.
+func happyDial(ips []net.IP, port string, timeout time.Duration, localAddr func(net.IP) net.Addr) (conn net.Conn, err error) {
+	if len(ips) == 0 {
+		return nil, DNS_NO_SUCH_HOST
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	var (
+		results = make(chan *dialResult, len(ips))
+		delay   = time.NewTimer(0)
+		next    int
+		running int
+	)
+	defer func() {
+		delay.Stop()
+		cancel()
+		// close the late winners
+		go func(n int) {
+			for ; n > 0; n-- {
+				if r := <-results; r.conn != nil {
+					r.conn.Close()
+				}
+			}
+		}(running)
+	}()
+	var attempt = func(ip net.IP) {
+		var dialer = &net.Dialer{}
+		if localAddr != nil {
+			dialer.LocalAddr = localAddr(ip)
+		}
+		c, e := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+		results <- &dialResult{c, e}
+	}
+	for {
+		select {
+		case <-delay.C:
+			if next < len(ips) {
+				running++
+				go attempt(ips[next])
+				next++
+				delay.Reset(HE_ATTEMPT_DELAY)
+			}
+		case r := <-results:
+			running--
+			if r.err == nil {
+				return r.conn, nil
+			}
+			err = r.err
+			if next < len(ips) { // start the next immediately
+				delay.Stop()
+				delay.Reset(0)
+			} else if running == 0 {
+				return nil, err
+			}
+		}
+	}
+}
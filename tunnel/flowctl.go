@@ -0,0 +1,71 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+const (
+	// initial send credit of each stream
+	STREAM_WINDOW_SIZE = 1 << 20
+	// grant credit to peer when consumed half window
+	STREAM_WINDOW_UPDATE = STREAM_WINDOW_SIZE >> 1
+)
+
+// send credit of stream, the relay must acquire credit before reading
+// from the edge, and the peer grants credit after delivered.
+type window struct {
+	lock   sync.Locker
+	cond   *sync.Cond
+	credit int
+	closed bool
+}
+
+func newWindow(size int) *window {
+	l := new(sync.Mutex)
+	return &window{
+		lock:   l,
+		cond:   sync.NewCond(l),
+		credit: size,
+	}
+}
+
+// block until having credit, returns the acquired or 0 if closed.
+func (w *window) acquire(max int) int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for w.credit <= 0 && !w.closed {
+		w.cond.Wait()
+	}
+	if w.closed {
+		return 0
+	}
+	if max > w.credit {
+		max = w.credit
+	}
+	w.credit -= max
+	return max
+}
+
+func (w *window) grant(n int) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.credit += n
+	w.cond.Broadcast()
+}
+
+func (w *window) close() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.closed = true
+	w.cond.Broadcast()
+}
+
+// SLOWDOWN frame carries the credit increment for the sid
+func grantPeer(tun *Conn, sid uint32, increment int) error {
+	hlen := tun.headerLen()
+	buf := make([]byte, hlen+4)
+	_frame(buf, hlen, FRAME_ACTION_SLOWDOWN, sid, uint16(4))
+	binary.BigEndian.PutUint32(buf[hlen:], uint32(increment))
+	return tunWrite1(tun, buf)
+}
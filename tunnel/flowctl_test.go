@@ -0,0 +1,45 @@
+package tunnel
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_window(t *testing.T) {
+	w := newWindow(100)
+	if n := w.acquire(60); n != 60 {
+		t.Errorf("acquired %d", n)
+	}
+	if n := w.acquire(60); n != 40 {
+		t.Errorf("acquired %d", n)
+	}
+	var acquired = make(chan int)
+	go func() {
+		acquired <- w.acquire(60)
+	}()
+	select {
+	case n := <-acquired:
+		t.Fatalf("acquired %d without credit", n)
+	case <-time.After(time.Millisecond * 100):
+	}
+	w.grant(30)
+	if n := <-acquired; n != 30 {
+		t.Errorf("acquired %d after granted", n)
+	}
+	go func() {
+		acquired <- w.acquire(60)
+	}()
+	w.close()
+	if n := <-acquired; n != 0 {
+		t.Errorf("acquired %d after closed", n)
+	}
+}
+
+func Test_clientFeatures(t *testing.T) {
+	if f := parseClientFeatures("user\x00pass"); f != 0 {
+		t.Errorf("older client features=%x", f)
+	}
+	if f := parseClientFeatures("user\x00pass\x00000908c00001"); f != 1 {
+		t.Errorf("client features=%x", f)
+	}
+}
@@ -0,0 +1,145 @@
+package tunnel
+
+import (
+	ex "github.com/spance/deblocus/exception"
+	log "github.com/spance/deblocus/golang/glog"
+	"net"
+	"sync"
+	"time"
+)
+
+type ClientSelector interface {
+	SelectClient(target string, src net.Addr) *Client
+}
+
+// local proxy service of client side
+// handshake with the user agent then dispatch requests into a selected tunnel.
+type Frontend struct {
+	listener *Listener
+	selector ClientSelector
+	pac      *pacFile
+	lock     sync.Locker
+}
+
+func NewFrontend(conf *D5ClientConf, listener *Listener, selector ClientSelector) *Frontend {
+	return &Frontend{
+		listener: listener,
+		selector: selector,
+		pac:      conf.pac,
+		lock:     new(sync.Mutex),
+	}
+}
+
+// apply the rules of the reloaded config
+func (f *Frontend) Reload(conf *D5ClientConf) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.pac = conf.pac
+}
+
+func (f *Frontend) getPAC() *pacFile {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.pac
+}
+
+// serve requests of the listener until it was closed
+func (f *Frontend) ServeListener(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err == nil {
+			go f.Serve(conn)
+		} else {
+			if ne, y := err.(net.Error); y && ne.Temporary() {
+				time.Sleep(time.Millisecond * 10)
+				continue
+			}
+			return err
+		}
+	}
+}
+
+// without any handshake, the target was known by the listener
+func (f *Frontend) serveDirectly(conn net.Conn) (done bool) {
+	var prot, target string
+	if f.listener.is(LISTEN_FORWARD) {
+		prot, target = "FORWARD", f.listener.forward
+	} else {
+		var err error
+		prot = "TRANSPARENT"
+		target, err = originalDestination(conn)
+		ThrowErr(err)
+	}
+	if client := f.selector.SelectClient(target, conn.RemoteAddr()); client != nil {
+		client.mux.HandleRequest(prot, conn, target)
+		return true
+	}
+	return false
+}
+
+func (f *Frontend) Serve(conn net.Conn) {
+	var done bool
+	defer func() {
+		ex.CatchException(recover())
+		if !done {
+			SafeClose(conn)
+		}
+	}()
+
+	if f.listener.is(LISTEN_TRANSPARENT | LISTEN_FORWARD) {
+		done = f.serveDirectly(conn)
+		return
+	}
+	pbConn := NewPushbackInputStream(conn)
+	prot := detectProtocol(pbConn)
+	if prot == REQ_PROT_SOCKS5 && !f.listener.is(LISTEN_SOCKS5) ||
+		prot == REQ_PROT_HTTP && !f.listener.is(LISTEN_HTTP) {
+		log.Warningf("Disallowed protocol on %s from %s\n", f.listener, conn.RemoteAddr())
+		return
+	}
+	switch prot {
+	case REQ_PROT_SOCKS5:
+		s5 := S5Step1{conn: pbConn}
+		s5.Handshake()
+		if !s5.HandshakeAck() {
+			literalTarget := s5.parseSocks5Request()
+			var client *Client
+			if s5.err == nil {
+				if client = f.selector.SelectClient(literalTarget, conn.RemoteAddr()); client == nil {
+					s5.err = GENERAL_FAILURE
+				}
+			}
+			if !s5.respondSocks5() {
+				client.mux.HandleRequest("SOCKS5", conn, literalTarget)
+				done = true
+			}
+		}
+	case REQ_PROT_HTTP:
+		prot, literalTarget := httpProxyHandshake(pbConn)
+		switch prot {
+		case REQ_PROT_UNKNOWN: // responded
+			return
+		case REQ_PROT_LOCAL, REQ_PROT_LOCAL_HEAD: // proxy.pac
+			if log.V(2) {
+				log.Infoln("Local request", literalTarget, "from", conn.RemoteAddr())
+			}
+			f.getPAC().serve(pbConn, literalTarget, prot == REQ_PROT_LOCAL_HEAD)
+			return
+		}
+		client := f.selector.SelectClient(literalTarget, conn.RemoteAddr())
+		if client == nil {
+			respondHttp(pbConn, "503 Service Unavailable", NULL, nil, false)
+			return
+		}
+		if prot == REQ_PROT_HTTP { // plain http
+			client.mux.HandleRequest("HTTP", pbConn, literalTarget)
+		} else { // http tunnel
+			respondHttpTunnel(pbConn)
+			client.mux.HandleRequest("HTTP/T", conn, literalTarget)
+		}
+		done = true
+	default:
+		log.Warningln("unrecognized request from", conn.RemoteAddr())
+		time.Sleep(REST_INTERVAL)
+	}
+}
@@ -0,0 +1,202 @@
+package tunnel
+
+import (
+	"fmt"
+	"github.com/spance/deblocus/exception"
+	log "github.com/spance/deblocus/golang/glog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	HEALTH_HEALTHY = iota
+	HEALTH_DEGRADED
+	HEALTH_UNHEALTHY
+)
+
+const (
+	// rolling window of probes
+	HEALTH_WINDOW = 10
+	// success rate in percent below which
+	HEALTH_DEGRADED_RATE  = 90
+	HEALTH_UNHEALTHY_RATE = 50
+	// degraded if opening slower than
+	HEALTH_SLOW_LATENCY = time.Second * 3
+	HEALTH_INTERVAL     = 30 // second
+)
+
+var (
+	HEALTH_CHECK_FAILED = exception.NewW("Health check failed")
+	// OPEN_N by the target or the outbound policy, it's not the fault of tun
+	HEALTH_PROBE_REFUSED = exception.NewW("Probe was refused by peer")
+	healthNames          = []string{"healthy", "degraded", "unhealthy"}
+)
+
+// rolling success rate and smoothed latency of the probes
+type healthStats struct {
+	lock    sync.Locker
+	results [HEALTH_WINDOW]bool
+	count   int
+	next    int
+	latency time.Duration
+	status  int
+}
+
+func newHealthStats() *healthStats {
+	return &healthStats{lock: new(sync.Mutex)}
+}
+
+// returns true if the status was changed
+func (h *healthStats) record(ok bool, latency time.Duration) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.results[h.next] = ok
+	h.next = (h.next + 1) % HEALTH_WINDOW
+	if h.count < HEALTH_WINDOW {
+		h.count++
+	}
+	if ok {
+		if h.latency == 0 {
+			h.latency = latency
+		} else {
+			h.latency = (7*h.latency + latency) >> 3
+		}
+	}
+	var (
+		rate   = h._rate()
+		status = HEALTH_HEALTHY
+	)
+	switch {
+	case rate < HEALTH_UNHEALTHY_RATE:
+		status = HEALTH_UNHEALTHY
+	case rate < HEALTH_DEGRADED_RATE || h.latency > HEALTH_SLOW_LATENCY:
+		status = HEALTH_DEGRADED
+	}
+	changed := status != h.status
+	h.status = status
+	return changed
+}
+
+// success rate in percent
+func (h *healthStats) _rate() int {
+	if h.count == 0 {
+		return 100
+	}
+	var n int
+	for i := 0; i < h.count; i++ {
+		if h.results[i] {
+			n++
+		}
+	}
+	return n * 100 / h.count
+}
+
+// forget the results while probing is off
+func (h *healthStats) reset() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.count, h.next, h.latency, h.status = 0, 0, 0, HEALTH_HEALTHY
+}
+
+func (h *healthStats) getStatus() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.status
+}
+
+func (h *healthStats) String() string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return fmt.Sprintf("%s(%d%% %s)", healthNames[h.status], h._rate(), h.latency/time.Millisecond*time.Millisecond)
+}
+
+// host:port[,seconds]
+func parseProbe(literal string) (target string, interval int, e error) {
+	target, interval = literal, HEALTH_INTERVAL
+	if comma := strings.LastIndex(literal, ","); comma > 0 {
+		target = strings.TrimSpace(literal[:comma])
+		interval, e = strconv.Atoi(strings.TrimSpace(literal[comma+1:]))
+		if e != nil || interval < 1 {
+			return NULL, 0, CONF_ERROR.Apply("Probe interval " + literal)
+		}
+	}
+	if target != NULL {
+		if _, e = IsValidHost(target); e != nil {
+			return NULL, 0, CONF_ERROR.Apply(e)
+		}
+	}
+	return
+}
+
+// open a stream to the target then close it, returns the latency of opening.
+// HEALTH_PROBE_REFUSED will be returned if the peer could not open the target.
+func (p *multiplexer) probe(target string) (time.Duration, error) {
+	tun := p.pool.Select()
+	if tun == nil {
+		return 0, HEALTH_CHECK_FAILED.Apply("no tun")
+	}
+	local, remote := net.Pipe()
+	defer SafeClose(local)
+	edge := p.router.allocate(tun, target, remote)
+	if edge == nil {
+		SafeClose(remote)
+		return 0, HEALTH_CHECK_FAILED.Apply("no available sid")
+	}
+	defer edge.abandon()
+	var (
+		hlen  = tun.headerLen()
+		buf   = make([]byte, hlen+len(target)+1)
+		start = time.Now()
+		code  = p.open(edge, tun, buf)
+	)
+	switch code {
+	case FRAME_ACTION_OPEN_Y:
+	case FRAME_ACTION_OPEN_N:
+		return 0, HEALTH_PROBE_REFUSED
+	default: // timeout or broken tun
+		return 0, HEALTH_CHECK_FAILED.Apply(target)
+	}
+	latency := time.Since(start)
+	// release the peer
+	_frame(buf, hlen, FRAME_ACTION_CLOSE_W, edge.sid, nil)
+	tunWrite1(tun, buf[:hlen])
+	_frame(buf, hlen, FRAME_ACTION_CLOSE_R, edge.sid, nil)
+	tunWrite1(tun, buf[:hlen])
+	return latency, nil
+}
+
+// the target and interval are read in each round for reloading
+func (c *Client) healthLoop() {
+	for {
+		var interval = c.params().checkInterval
+		if interval < 1 {
+			interval = HEALTH_INTERVAL
+		}
+		time.Sleep(time.Duration(interval) * time.Second)
+		if c.mux.closing() {
+			return
+		}
+		var target = c.params().checkTarget
+		if target == NULL {
+			c.health.reset()
+			continue
+		}
+		if atomic.LoadInt32(&c.State) < 0 {
+			continue
+		}
+		latency, err := c.mux.probe(target)
+		if err != nil && log.V(2) {
+			log.Warningf("Probe %s via %s: %s\n", target, c.nego.RemoteName(), err)
+		}
+		if err == HEALTH_PROBE_REFUSED {
+			continue // the gateway is working
+		}
+		if c.health.record(err == nil, latency) {
+			log.Warningf("Gateway %s became %s\n", c.nego.RemoteName(), c.health)
+		}
+	}
+}
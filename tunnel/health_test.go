@@ -0,0 +1,85 @@
+package tunnel
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_healthStats(t *testing.T) {
+	var h = newHealthStats()
+	for i := 0; i < HEALTH_WINDOW; i++ {
+		h.record(true, 10*time.Millisecond)
+	}
+	if h.getStatus() != HEALTH_HEALTHY {
+		t.Fatalf("expected healthy but %s", h)
+	}
+	// 80%
+	h.record(false, 0)
+	if !h.record(false, 0) || h.getStatus() != HEALTH_DEGRADED {
+		t.Fatalf("expected degraded but %s", h)
+	}
+	for i := 0; i < 4; i++ {
+		h.record(false, 0)
+	}
+	if h.getStatus() != HEALTH_UNHEALTHY {
+		t.Fatalf("expected unhealthy but %s", h)
+	}
+	for i := 0; i < HEALTH_WINDOW; i++ {
+		h.record(true, HEALTH_SLOW_LATENCY*2)
+	}
+	if h.getStatus() != HEALTH_DEGRADED {
+		t.Fatalf("expected degraded by latency but %s", h)
+	}
+}
+
+func Test_probe(t *testing.T) {
+	target := listenLocal(t, func(conn net.Conn) {
+		buf := make([]byte, 1)
+		conn.Read(buf) // until closed by peer
+		conn.Close()
+	})
+	defer target.Close()
+	var (
+		svr = NewServerMultiplexer()
+		clt = NewClientMultiplexer()
+	)
+	defer svr.router.stopCleanTask()
+	defer clt.router.stopCleanTask()
+	svrLn := listenLocal(t, func(conn net.Conn) {
+		svr.Listen(newTestConn(conn), nil, 0)
+	})
+	defer svrLn.Close()
+	conn, e := net.Dial("tcp", svrLn.Addr().String())
+	if e != nil {
+		t.Fatal(e)
+	}
+	go clt.Listen(newTestConn(conn), nil, 0)
+	defer conn.Close()
+	for clt.pool.Len() < 1 {
+		rest(-1)
+	}
+	if latency, e := clt.probe(target.Addr().String()); e != nil || latency <= 0 {
+		t.Fatalf("probe latency=%s error=%v", latency, e)
+	}
+	// the peer stream was released
+	for i := 0; svr.router.live() > 0; i++ {
+		if i > 20 {
+			t.Fatalf("probe stream was not released by peer")
+		}
+		rest(-1)
+	}
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	ln.Close()
+	// the refusal of target is not a failure of tun
+	if _, e := clt.probe(ln.Addr().String()); e != HEALTH_PROBE_REFUSED {
+		t.Fatalf("probe a closed port %v", e)
+	}
+	conn.Close()
+	for clt.pool.Len() > 0 {
+		rest(-1)
+	}
+	if _, e := clt.probe(target.Addr().String()); e == nil || e == HEALTH_PROBE_REFUSED {
+		t.Fatalf("probe without tun %v", e)
+	}
+}
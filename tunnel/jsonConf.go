@@ -0,0 +1,378 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	JSON_SUFFIX = ".json"
+	// the PEM blocks, d5p fragments of client or private key of server
+	JSON_KEYS = "Keys"
+)
+
+// JSON config is an object of the importable fields, the list fields could be
+// an array, and the items of listeners, outbound rules and proxy could be the
+// nested objects or the text form, eg.
+//
+//	{
+//	  "Listen": [":9009", {"proto": ["transparent"], "addr": "127.0.0.1:9040"}],
+//	  "Verbose": 1,
+//	  "Proxy": {"scheme": "socks5", "addr": "127.0.0.1:1080", "user": "u", "pass": "p"},
+//	  "Outbound": [{"user": "alice", "via": "socks5://127.0.0.1:1080"}, {"via": "direct"}],
+//	  "Keys": ["-----BEGIN ...-----\n...\n-----END ...-----\n"]
+//	}
+func isJSONConf(path string) bool {
+	return strings.HasSuffix(strings.ToLower(path), JSON_SUFFIX)
+}
+
+// the nested object in JSON of the field tagged by object:"name"
+type jsonObject interface {
+	parse(item string) error // from the text form
+	literal() string
+}
+
+var jsonObjects = map[string]func() jsonObject{
+	"listener": func() jsonObject { return new(jsonListener) },
+	"outbound": func() jsonObject { return new(jsonOutboundRule) },
+	"proxy":    func() jsonObject { return new(jsonProxy) },
+}
+
+// the protocols in order of the bits
+var listenProtocolNames = []string{"socks5", "http", "transparent", "forward"}
+
+type jsonListener struct {
+	Proto   []string `json:"proto,omitempty"` // socks5 and http by default
+	Addr    string   `json:"addr"`            // host:port or unix:path
+	Forward string   `json:"forward,omitempty"`
+	Mode    string   `json:"mode,omitempty"` // of unix socket file
+}
+
+func (o *jsonListener) parse(spec string) error {
+	l, e := parseListener(spec)
+	if e != nil {
+		return e
+	}
+	if l.protocols != LISTEN_DEFAULT {
+		for i, name := range listenProtocolNames {
+			if l.protocols&(1<<uint(i)) != 0 {
+				o.Proto = append(o.Proto, name)
+			}
+		}
+	}
+	o.Addr, o.Forward = l.Address, l.forward
+	if l.Network == "unix" {
+		o.Addr = UNIX_PREFIX + l.Address
+	}
+	if l.mode != 0 {
+		o.Mode = fmt.Sprintf("%#o", l.mode)
+	}
+	return nil
+}
+
+func (o *jsonListener) literal() string {
+	var spec, protocols = o.Addr, o.Proto
+	if o.Mode != NULL {
+		spec += UNIX_MODE + o.Mode
+	}
+	if o.Forward != NULL && len(protocols) == 0 {
+		protocols = []string{"forward"}
+	}
+	if len(protocols) > 0 {
+		var names = make([]string, len(protocols))
+		for i, p := range protocols {
+			if names[i] = p; p == "forward" {
+				names[i] = "forward=" + o.Forward
+			}
+		}
+		spec = strings.Join(names, "+") + "@" + spec
+	}
+	return spec
+}
+
+// the rule matches any if neither user nor dest
+type jsonOutboundRule struct {
+	User string `json:"user,omitempty"`
+	Dest string `json:"dest,omitempty"` // domain, *.domain, ip or cidr
+	Via  string `json:"via"`            // direct, bind:IP, iface:NAME or proxy uri
+}
+
+func (o *jsonOutboundRule) parse(item string) error {
+	if _, e := parseOutboundPolicy(item); e != nil {
+		return e
+	}
+	var matcher = MATCH_ANY
+	o.Via = strings.TrimSpace(item)
+	if eq := strings.Index(item, "="); eq > 0 && !strings.Contains(item[:eq], "://") {
+		matcher, o.Via = strings.TrimSpace(item[:eq]), strings.TrimSpace(item[eq+1:])
+	}
+	switch {
+	case strings.HasPrefix(matcher, MATCH_USER):
+		o.User = matcher[len(MATCH_USER):]
+	case strings.HasPrefix(matcher, MATCH_DEST):
+		o.Dest = matcher[len(MATCH_DEST):]
+	}
+	return nil
+}
+
+func (o *jsonOutboundRule) literal() string {
+	switch {
+	case o.User != NULL && o.Dest != NULL:
+		panic(INVALID_OUTBOUND.Apply("both user and dest of " + o.Via))
+	case o.User != NULL:
+		return MATCH_USER + o.User + "=" + o.Via
+	case o.Dest != NULL:
+		return MATCH_DEST + o.Dest + "=" + o.Via
+	}
+	return MATCH_ANY + "=" + o.Via
+}
+
+type jsonProxy struct {
+	Scheme string `json:"scheme"` // socks5 or http
+	Addr   string `json:"addr"`
+	User   string `json:"user,omitempty"`
+	Pass   string `json:"pass,omitempty"`
+}
+
+func (o *jsonProxy) parse(uri string) error {
+	p, e := parseUpstreamProxy(uri)
+	if e != nil {
+		return e
+	}
+	o.Scheme, o.Addr, o.User, o.Pass = p.scheme, p.addr, p.user, p.pass
+	return nil
+}
+
+func (o *jsonProxy) literal() string {
+	var u = &url.URL{Scheme: o.Scheme, Host: o.Addr}
+	if o.User != NULL || o.Pass != NULL {
+		u.User = url.UserPassword(o.User, o.Pass)
+	}
+	return u.String()
+}
+
+// decode the nested object of field into the text form
+func (d *FieldDescriptor) objectLiteral(value map[string]interface{}) string {
+	newObject, y := jsonObjects[d.sType.Tag.Get("object")]
+	if !y {
+		panic(CONF_ERROR.Apply(d.sType.Name + " is not an object"))
+	}
+	data, e := json.Marshal(value)
+	ThrowErr(e)
+	var (
+		obj = newObject()
+		dec = json.NewDecoder(bytes.NewReader(data))
+	)
+	dec.DisallowUnknownFields()
+	if e = dec.Decode(obj); e != nil {
+		panic(CONF_ERROR.Apply(d.sType.Name + " " + e.Error()))
+	}
+	return obj.literal()
+}
+
+func parseJSONConf(data []byte, desc ImportableFieldDesc, directive func(line int, k, v string), kParse keyParser) {
+	members, e := readJSONMembers(data)
+	if e != nil {
+		panic(CONF_ERROR.Apply(e))
+	}
+	for _, m := range members {
+		if m.key == JSON_KEYS {
+			var keys []string
+			if e := json.Unmarshal(m.value, &keys); e != nil {
+				panic(CONF_ERROR.Apply(m.key + " " + e.Error()))
+			}
+			for _, key := range keys {
+				kParse([]byte(key))
+			}
+			continue
+		}
+		d, y := desc[m.key]
+		if !y {
+			panic(UNRECOGNIZED_DIRECTIVES.Apply(m.key))
+		}
+		var value interface{}
+		if e := json.Unmarshal(m.value, &value); e != nil {
+			panic(CONF_ERROR.Apply(m.key + " " + e.Error()))
+		}
+		if value != nil {
+			directive(m.line, m.key, d.literal(value))
+		}
+	}
+}
+
+// a member of the top-level object, and the line of its key
+type jsonMember struct {
+	key   string
+	value json.RawMessage
+	line  int
+}
+
+// the members in order including the duplicate keys, which are dropped by
+// unmarshalling into map.
+func readJSONMembers(data []byte) ([]*jsonMember, error) {
+	var dec = json.NewDecoder(bytes.NewReader(data))
+	if t, e := dec.Token(); e != nil {
+		return nil, e
+	} else if t != json.Delim('{') {
+		return nil, CONF_ERROR.Apply("expected an object")
+	}
+	var members []*jsonMember
+	for dec.More() {
+		t, e := dec.Token()
+		if e != nil {
+			return nil, e
+		}
+		// the key never spans lines, and the offset is at its end.
+		var m = &jsonMember{key: t.(string), line: lineAt(data, dec.InputOffset())}
+		if e = dec.Decode(&m.value); e != nil {
+			return nil, e
+		}
+		members = append(members, m)
+	}
+	if _, e := dec.Token(); e != nil {
+		return nil, e
+	}
+	if _, e := dec.Token(); e != io.EOF {
+		return nil, CONF_ERROR.Apply("unexpected data after the object")
+	}
+	return members, nil
+}
+
+// the line number of offset counting from 1, or 0 if unknown
+func lineAt(data []byte, offset int64) int {
+	if offset < 0 || offset > int64(len(data)) {
+		return 0
+	}
+	return bytes.Count(data[:offset], []byte{'\n'}) + 1
+}
+
+// the text form of JSON value
+func (d *FieldDescriptor) literal(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case map[string]interface{}:
+		return d.objectLiteral(v)
+	case []interface{}:
+		sep := d.sType.Tag.Get("list")
+		if sep != NULL {
+			var items = make([]string, len(v))
+			for i, item := range v {
+				items[i] = d.literal(item)
+			}
+			return strings.Join(items, sep)
+		}
+	}
+	panic(CONF_ERROR.Apply(d.sType.Name))
+}
+
+// the JSON value of text form, the list will be split into array, and the
+// items of object field will be the nested objects.
+func (d *FieldDescriptor) jsonValue(v string) interface{} {
+	switch d.fValue.Kind() {
+	case reflect.Bool:
+		vv, e := strconv.ParseBool(v)
+		ThrowErr(e)
+		return vv
+	case reflect.Int:
+		vv, e := strconv.ParseInt(v, 10, 0)
+		ThrowErr(e)
+		return vv
+	case reflect.Float32:
+		vv, e := strconv.ParseFloat(v, 32)
+		ThrowErr(e)
+		return vv
+	}
+	var (
+		items     []string
+		newObject = jsonObjects[d.sType.Tag.Get("object")]
+	)
+	switch sep := d.sType.Tag.Get("list"); sep {
+	case NULL:
+		if newObject != nil {
+			return d.jsonObject(newObject, v)
+		}
+		return v
+	case " ":
+		items = strings.Fields(v)
+	default:
+		for _, item := range strings.Split(v, sep) {
+			if item = strings.TrimSpace(item); item != NULL {
+				items = append(items, item)
+			}
+		}
+	}
+	if newObject != nil {
+		var objects = make([]jsonObject, len(items))
+		for i, item := range items {
+			objects[i] = d.jsonObject(newObject, item)
+		}
+		return objects
+	}
+	if len(items) == 1 {
+		return items[0]
+	}
+	return items
+}
+
+func (d *FieldDescriptor) jsonObject(newObject func() jsonObject, item string) jsonObject {
+	var obj = newObject()
+	if e := obj.parse(item); e != nil {
+		panic(CONF_ERROR.Apply(d.sType.Name + " " + e.Error()))
+	}
+	return obj
+}
+
+// convert the text format config file into JSON
+func ConvertToJSON(input, output string, isServ bool) (e error) {
+	var instance interface{} = new(D5ClientConf)
+	if isServ {
+		instance = new(D5ServConf)
+	}
+	in, e := os.Open(input)
+	ThrowErr(e)
+	defer in.Close()
+	var (
+		desc = getImportableDesc(instance)
+		doc  = make(map[string]interface{})
+		keys []string
+	)
+	readD5Conf(in, func(_ int, k, v string) {
+		if v == NULL {
+			panic(UNRECOGNIZED_SYMBOLS.Apply(k))
+		}
+		if d, y := desc[k]; y {
+			doc[k] = d.jsonValue(v)
+		} else {
+			panic(UNRECOGNIZED_DIRECTIVES.Apply("at line: " + k + " " + v))
+		}
+	}, func(_ int, block []byte) {
+		keys = append(keys, string(block))
+	})
+	if len(keys) > 0 {
+		doc[JSON_KEYS] = keys
+	}
+	data, e := json.MarshalIndent(doc, "", "  ")
+	ThrowErr(e)
+	data = append(data, '\n')
+	var f = os.Stdout
+	if output != NULL {
+		// may contain the secret key
+		f, e = os.OpenFile(output, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0600)
+		ThrowErr(e)
+		defer f.Close()
+	}
+	_, e = f.Write(data)
+	return
+}
@@ -0,0 +1,110 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"github.com/spance/deblocus/auth"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_convertToJSON(t *testing.T) {
+	dir, e := ioutil.TempDir("", "deblocus")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	var (
+		d5s  = &D5ServConf{Listen: "127.0.0.1:9008", ServerName: "test", Algo: "AES128CFB", RSAKeys: testRSAKeys(t)}
+		text = filepath.Join(dir, "deblocus.d5c")
+		js   = filepath.Join(dir, "deblocus.d5c.json")
+	)
+	conf := "Listen :9009 transparent@127.0.0.1:9040\nVerbose 2\nPriority port:22=high; *=normal\n" +
+		d5s.Export_d5p(&auth.User{Name: "u", Pass: "p"})
+	if e = ioutil.WriteFile(text, []byte(conf), 0600); e != nil {
+		t.Fatal(e)
+	}
+	if e = ConvertToJSON(text, js, false); e != nil {
+		t.Fatal(e)
+	}
+	var (
+		a = Parse_d5cFile(text)
+		b = Parse_d5cFile(js)
+	)
+	if len(b.Listeners) != 2 || b.Verbose != 2 || len(b.D5PList) != 1 {
+		t.Fatalf("listeners=%d verbose=%d d5p=%d", len(b.Listeners), b.Verbose, len(b.D5PList))
+	}
+	// including the priority rules
+	if x, y := a.D5PList[0].Fingerprint(), b.D5PList[0].Fingerprint(); x != y {
+		t.Fatalf("converted config differs\n%s\n%s", x, y)
+	}
+	// the listeners are nested objects
+	data, _ := ioutil.ReadFile(js)
+	if !strings.Contains(string(data), `"proto": [`) {
+		t.Fatalf("converted listeners %s", data)
+	}
+	// decided by the extension only
+	if e = ioutil.WriteFile(text, data, 0600); e != nil {
+		t.Fatal(e)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("JSON was loaded from %s", text)
+		}
+	}()
+	Parse_d5cFile(text)
+}
+
+func Test_jsonObjects(t *testing.T) {
+	var (
+		d5c  = getImportableDesc(new(D5ClientConf))
+		d5s  = getImportableDesc(new(D5ServConf))
+		desc = func(name string) *FieldDescriptor {
+			if d := d5c[name]; d != nil {
+				return d
+			}
+			return d5s[name]
+		}
+	)
+	var cases = []struct {
+		field, json, literal string
+	}{
+		{"Listen", `[":9009", {"proto": ["transparent"], "addr": "127.0.0.1:9040"}]`, ":9009 transparent@127.0.0.1:9040"},
+		{"Listen", `{"addr": "unix:/tmp/d.sock", "mode": "0660"}`, "unix:/tmp/d.sock?mode=0660"},
+		{"Listen", `{"proto": ["http"], "addr": "unix:@deblocus"}`, "http@unix:@deblocus"},
+		{"Listen", `{"forward": "example.com:22", "addr": "127.0.0.1:2222"}`, "forward=example.com:22@127.0.0.1:2222"},
+		{"Proxy", `{"scheme": "socks5", "addr": "127.0.0.1:1080", "user": "u", "pass": "p"}`, "socks5://u:p@127.0.0.1:1080"},
+		{"Outbound", `[{"user": "alice", "via": "socks5://127.0.0.1:1080"}, {"dest": "10.0.0.0/8", "via": "bind:10.0.0.1"}, {"via": "direct"}]`,
+			"user:alice=socks5://127.0.0.1:1080;dest:10.0.0.0/8=bind:10.0.0.1;*=direct"},
+	}
+	for _, c := range cases {
+		var value interface{}
+		if e := json.Unmarshal([]byte(c.json), &value); e != nil {
+			t.Fatal(e)
+		}
+		d := desc(c.field)
+		if v := d.literal(value); v != c.literal {
+			t.Errorf("%s literal=%s expected=%s", c.field, v, c.literal)
+		}
+		// converted back to the objects
+		data, _ := json.Marshal(d.jsonValue(c.literal))
+		if e := json.Unmarshal(data, &value); e != nil {
+			t.Fatal(e)
+		}
+		if v := d.literal(value); v != c.literal {
+			t.Errorf("%s converted=%s expected=%s", c.field, data, c.literal)
+		}
+	}
+	var value interface{}
+	json.Unmarshal([]byte(`{"scheme": "socks5", "address": "127.0.0.1:1080"}`), &value)
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("unknown key of object was accepted")
+			}
+		}()
+		desc("Proxy").literal(value)
+	}()
+}
@@ -0,0 +1,163 @@
+package tunnel
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// local listener protocols
+	LISTEN_SOCKS5 = 1 << iota
+	LISTEN_HTTP
+	LISTEN_TRANSPARENT
+	LISTEN_FORWARD
+	LISTEN_DEFAULT = LISTEN_SOCKS5 | LISTEN_HTTP
+	UNIX_PREFIX    = "unix:"
+	UNIX_MODE      = "?mode="
+)
+
+var listenProtocols = map[string]int{
+	"socks5":      LISTEN_SOCKS5,
+	"http":        LISTEN_HTTP,
+	"transparent": LISTEN_TRANSPARENT,
+	"forward":     LISTEN_FORWARD,
+}
+
+// Listener is a local service address of client with its protocol set.
+// spec: [protocol[+protocol...]@]address
+//   :9009
+//   socks5@[::]:1080
+//   socks5+http@unix:/var/run/deblocus.sock
+//   http@unix:/var/run/deblocus.sock?mode=0660
+//   socks5@unix:@deblocus (abstract on linux)
+//   transparent@127.0.0.1:9040
+//   forward=example.com:22@127.0.0.1:2222
+// the unix socket file is created by umask unless the mode was given.
+type Listener struct {
+	Network   string
+	Address   string
+	protocols int
+	forward   string
+	mode      os.FileMode
+}
+
+func parseListener(spec string) (*Listener, error) {
+	var l = &Listener{Network: "tcp", Address: spec}
+	// the protocols never contain @, but the abstract unix address does.
+	if at := strings.Index(spec, "@"); at >= 0 && !strings.HasPrefix(spec, UNIX_PREFIX) {
+		l.Address = spec[at+1:]
+		for _, p := range strings.Split(spec[:at], "+") {
+			if strings.HasPrefix(p, "forward=") {
+				l.forward = p[8:]
+				if _, err := IsValidHost(l.forward); err != nil {
+					return nil, err
+				}
+				p = "forward"
+			}
+			if v, y := listenProtocols[p]; y {
+				l.protocols |= v
+			} else {
+				return nil, LOCAL_BIND_ERROR.Apply("unknown protocol " + p)
+			}
+		}
+	} else {
+		l.protocols = LISTEN_DEFAULT
+	}
+	// transparent and forward are exclusive with others
+	if p := l.protocols & (LISTEN_TRANSPARENT | LISTEN_FORWARD); p != 0 && p != l.protocols {
+		return nil, LOCAL_BIND_ERROR.Apply("exclusive protocol in " + spec)
+	}
+	if strings.HasPrefix(l.Address, UNIX_PREFIX) {
+		l.Network = "unix"
+		l.Address = l.Address[len(UNIX_PREFIX):]
+		if q := strings.LastIndex(l.Address, UNIX_MODE); q >= 0 {
+			mode, e := strconv.ParseUint(l.Address[q+len(UNIX_MODE):], 8, 32)
+			if e != nil || mode > 0777 || l.isAbstract() {
+				return nil, LOCAL_BIND_ERROR.Apply("invalid mode in " + spec)
+			}
+			l.Address, l.mode = l.Address[:q], os.FileMode(mode)
+		}
+		if l.Address == NULL || l.Address == "@" {
+			return nil, LOCAL_BIND_ERROR.Apply(spec)
+		}
+		if l.protocols&LISTEN_TRANSPARENT != 0 {
+			return nil, LOCAL_BIND_ERROR.Apply("transparent on unix socket")
+		}
+	} else if _, err := net.ResolveTCPAddr("tcp", l.Address); err != nil {
+		return nil, LOCAL_BIND_ERROR.Apply(err)
+	}
+	return l, nil
+}
+
+func parseListeners(list string) ([]*Listener, error) {
+	var listeners []*Listener
+	for _, spec := range strings.Fields(list) {
+		l, e := parseListener(spec)
+		if e != nil {
+			return nil, e
+		}
+		listeners = append(listeners, l)
+	}
+	if len(listeners) < 1 {
+		return nil, LOCAL_BIND_ERROR
+	}
+	return listeners, nil
+}
+
+func (l *Listener) Listen() (net.Listener, error) {
+	if l.Network != "unix" || l.isAbstract() {
+		return net.Listen(l.Network, l.Address)
+	}
+	// remove the stale socket file only if nobody is serving on it
+	if fi, e := os.Lstat(l.Address); e == nil && fi.Mode()&os.ModeSocket != 0 {
+		conn, e := net.Dial(l.Network, l.Address)
+		if e == nil {
+			conn.Close()
+			return nil, LOCAL_BIND_ERROR.Apply("in use " + l.Address)
+		}
+		if errors.Is(e, syscall.ECONNREFUSED) {
+			os.Remove(l.Address)
+		}
+	}
+	ln, e := net.Listen(l.Network, l.Address)
+	if e == nil && l.mode != 0 {
+		if e = os.Chmod(l.Address, l.mode); e != nil {
+			ln.Close()
+			return nil, e
+		}
+	}
+	return ln, e
+}
+
+// the linux abstract namespace has no file
+func (l *Listener) isAbstract() bool {
+	return l.Network == "unix" && strings.HasPrefix(l.Address, "@")
+}
+
+func (l *Listener) is(protocol int) bool {
+	return l.protocols&protocol != 0
+}
+
+func (l *Listener) String() string {
+	var names []string
+	for _, n := range []string{"socks5", "http", "transparent", "forward"} {
+		if l.is(listenProtocols[n]) {
+			names = append(names, n)
+		}
+	}
+	var addr = l.Address
+	if l.Network == "unix" {
+		addr = UNIX_PREFIX + addr
+		if l.mode != 0 {
+			addr += UNIX_MODE + "0" + strconv.FormatUint(uint64(l.mode), 8)
+		}
+	}
+	if l.forward != NULL {
+		addr = l.forward + " via " + addr
+	}
+	return strings.Join(names, "/") + "@" + addr
+}
@@ -0,0 +1,62 @@
+package tunnel
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_parseListener(t *testing.T) {
+	var cases = map[string]string{
+		":9009":                                 "socks5/http@:9009",
+		"socks5@[::]:1080":                      "socks5@[::]:1080",
+		"socks5+http@unix:/tmp/deblocus.sock":   "socks5/http@unix:/tmp/deblocus.sock",
+		"http@unix:/tmp/d.sock?mode=0660":       "http@unix:/tmp/d.sock?mode=0660",
+		"socks5@unix:@deblocus":                 "socks5@unix:@deblocus",
+		"unix:@deblocus":                        "socks5/http@unix:@deblocus",
+		"transparent@127.0.0.1:9040":            "transparent@127.0.0.1:9040",
+		"forward=example.com:22@127.0.0.1:2222": "forward@example.com:22 via 127.0.0.1:2222",
+	}
+	for spec, expected := range cases {
+		l, e := parseListener(spec)
+		if e != nil {
+			t.Errorf("%s error %v", spec, e)
+		} else if l.String() != expected {
+			t.Errorf("%s parsed as %s", spec, l)
+		}
+	}
+	for _, spec := range []string{"ftp@:21", "forward=x@:22", "socks5+forward=a:1@:22", "transparent@unix:/tmp/a", "socks5@unix:", "unix:/tmp/a?mode=999", "unix:@a?mode=0600"} {
+		if _, e := parseListener(spec); e == nil {
+			t.Errorf("%s should be invalid", spec)
+		}
+	}
+}
+
+func Test_listenUnix(t *testing.T) {
+	dir, e := ioutil.TempDir("", "deblocus")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	l, _ := parseListener("unix:" + filepath.Join(dir, "d.sock") + "?mode=0600")
+	ln, e := l.Listen()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if fi, _ := os.Stat(l.Address); fi.Mode().Perm() != 0600 {
+		t.Errorf("mode %v", fi.Mode())
+	}
+	// the live socket must not be stolen
+	if _, e := l.Listen(); e == nil {
+		t.Errorf("listened on the serving socket")
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	// the stale one will be replaced
+	if ln, e = l.Listen(); e != nil {
+		t.Fatal(e)
+	}
+	ln.Close()
+}
@@ -8,7 +8,7 @@ import (
 	"io"
 	"net"
 	"strconv"
-	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -23,15 +23,19 @@ const (
 	FRAME_ACTION_DATA
 	FRAME_ACTION_PING
 	FRAME_ACTION_PONG
-	FRAME_ACTION_SLOWDOWN = 0xff
+	FRAME_ACTION_RESUME
+	FRAME_ACTION_PADDING         // dropped by receiver
+	FRAME_ACTION_SLOWDOWN = 0xff // grant send credit to peer
 )
 
 const (
 	WAITING_OPEN_TIMEOUT = GENERAL_SO_TIMEOUT * 2
-	FRAME_HEADER_LEN     = 5
+	FRAME_HEADER_LEN     = 5 // action(1) sid(2) len(2)
+	FRAME_HEADER_LEN32   = 7 // action(1) sid(4) len(2) if FEATURE_SID32 negotiated
 	FRAME_MAX_LEN        = 0xffff
 	MUX_PENDING_CLOSE    = -1
 	MUX_CLOSED           = -2
+	DRAIN_CHECK_INTERVAL = time.Second
 )
 
 const (
@@ -41,15 +45,11 @@ const (
 	ERR_UNKNOWN      = 0x0
 )
 
-var (
-	SID_SEQ uint32
-	seqLock sync.Locker = new(sync.Mutex)
-)
-
 type idler struct {
 	enabled  bool
 	waiting  bool
 	interval time.Duration
+	pingTime time.Time // of the last ping
 }
 
 func NewIdler(interval int, isClient bool) *idler {
@@ -97,8 +97,9 @@ func (i *idler) consumeError(er error) uint {
 func (i *idler) ping(tun *Conn) error {
 	if i.enabled {
 		i.waiting = true
-		buf := make([]byte, FRAME_HEADER_LEN)
-		_frame(buf, FRAME_ACTION_PING, 0, nil)
+		i.pingTime = time.Now()
+		buf := make([]byte, tun.headerLen())
+		_frame(buf, len(buf), FRAME_ACTION_PING, 0, nil)
 		return tunWrite1(tun, buf)
 	}
 	return nil
@@ -106,17 +107,25 @@ func (i *idler) ping(tun *Conn) error {
 
 func (i *idler) pong(tun *Conn) error {
 	if i.enabled {
-		buf := make([]byte, FRAME_HEADER_LEN)
-		_frame(buf, FRAME_ACTION_PONG, 0, nil)
+		buf := make([]byte, tun.headerLen())
+		_frame(buf, len(buf), FRAME_ACTION_PONG, 0, nil)
 		return tunWrite1(tun, buf)
 	}
 	return nil
 }
 
-func (i *idler) verify() (r bool) {
+// the busy tun never times out in reading, eg. the cover traffic, but the
+// rtt should still be sampled in the interval.
+func (i *idler) sampleDue() bool {
+	return i.enabled && !i.waiting && time.Since(i.pingTime) > i.interval
+}
+
+// the rtt of tun will be measured by the expected pong
+func (i *idler) verify(tun *Conn) (r bool) {
 	r = i.waiting
 	if i.waiting {
 		i.waiting = false
+		tun.updateRTT(time.Since(i.pingTime))
 	}
 	return
 }
@@ -126,8 +135,9 @@ func (i *idler) verify() (r bool) {
 // --------------------
 type frame struct {
 	action uint8
-	sid    uint16
+	sid    uint32
 	length uint16
+	flags  uint8
 	data   []byte
 	conn   *edgeConn
 }
@@ -136,13 +146,11 @@ func (f *frame) String() string {
 	return fmt.Sprintf("Frame{sid=%d act=%d len=%d}", f.sid, f.action, f.length)
 }
 
-func (f *frame) toNewBuffer() []byte {
-	b := make([]byte, f.length+FRAME_HEADER_LEN)
-	b[0] = f.action
-	binary.BigEndian.PutUint16(b[1:], f.sid)
-	binary.BigEndian.PutUint16(b[3:], f.length)
+func (f *frame) toNewBuffer(hlen int) []byte {
+	b := make([]byte, int(f.length)+hlen)
+	_frame(b, hlen, f.action, f.sid, f.length)
 	if f.length > 0 {
-		copy(b[FRAME_HEADER_LEN:], f.data)
+		copy(b[hlen:], f.data)
 	}
 	return b
 }
@@ -151,11 +159,23 @@ func (f *frame) toNewBuffer() []byte {
 // multiplexer
 // --------------------
 type multiplexer struct {
+	saved    int64 // bytes saved by compression, keep 64-bit aligned
+	draining int32 // refusing the new streams
 	isClient bool
 	pool     *ConnPool
 	router   *egressRouter
 	mode     string
-	status   int
+	status   int32        // atomic, MUX_PENDING_CLOSE or MUX_CLOSED
+	settings atomic.Value // *muxSettings, replaced by reloading
+}
+
+type muxSettings struct {
+	outbound outboundPolicy
+	// bytes limit of each equeue, and reading the tun will be paused
+	// while the queued bytes of its edges exceeded TUN_QUEUE_FACTOR times.
+	queueLimit int
+	obfs       *obfuscator // padding the writings of tun
+	priority   priorityPolicy
 }
 
 func NewClientMultiplexer() *multiplexer {
@@ -164,77 +184,129 @@ func NewClientMultiplexer() *multiplexer {
 		pool:     NewConnPool(),
 		mode:     "CLT",
 	}
+	m.configure(&muxSettings{queueLimit: EQUEUE_LIMIT})
 	m.router = newEgressRouter(m)
 	return m
 }
 
 func NewServerMultiplexer() *multiplexer {
 	m := &multiplexer{mode: "SVR"}
+	m.configure(&muxSettings{queueLimit: EQUEUE_LIMIT})
 	m.router = newEgressRouter(m)
 	return m
 }
 
+// the settings are applied to the new tuns and streams
+func (p *multiplexer) configure(s *muxSettings) {
+	p.settings.Store(s)
+}
+
+func (p *multiplexer) conf() *muxSettings {
+	return p.settings.Load().(*muxSettings)
+}
+
 // destroy each listener of all pooled tun, and destroy egress queues
 func (p *multiplexer) destroy() {
 	defer func() {
 		if !ex.CatchException(recover()) {
-			p.status = MUX_CLOSED
+			atomic.StoreInt32(&p.status, MUX_CLOSED)
 		}
 	}()
 	// will not send evt_dt_closed while pending_close was indicated
-	p.status = MUX_PENDING_CLOSE
+	atomic.StoreInt32(&p.status, MUX_PENDING_CLOSE)
 	p.router.destroy() // destroy queue
-	p.pool.destroy()
+	if p.pool != nil {
+		p.pool.destroy()
+	}
 }
 
-func (p *multiplexer) HandleRequest(prot string, client net.Conn, target string) {
-	sid := _nextSID()
-	if log.V(1) {
-		log.Infof("%s->[%s] from=%s sid=%d\n", prot, target, ipAddr(client.RemoteAddr()), sid)
+func (p *multiplexer) closing() bool {
+	return atomic.LoadInt32(&p.status) < 0
+}
+
+// wait for the live streams to finish until timeout then destroy,
+// returns the quantity of streams were cut.
+func (p *multiplexer) drain(timeout time.Duration) int {
+	atomic.StoreInt32(&p.draining, 1)
+	var deadline = time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if p.router.live() == 0 {
+			break
+		}
+		time.Sleep(DRAIN_CHECK_INTERVAL)
 	}
+	live := p.router.live()
+	p.destroy()
+	return live
+}
+
+func (p *multiplexer) HandleRequest(prot string, client net.Conn, target string) {
 	tun := p.pool.Select()
 	ThrowIf(tun == nil, "No tun to deliveries request")
-	key := sessionKey(tun, sid)
-	edge := p.router.register(key, target, tun, client, true) // write edge
-	p.relay(edge, tun, sid)                                   // read edge
+	edge := p.router.allocate(tun, target, client) // write edge
+	ThrowIf(edge == nil, "No available sid")
+	edge.priority = p.conf().priority.classify(target)
+	if log.V(1) {
+		log.Infof("%s->[%s] from=%s sid=%d\n", prot, target, ipAddr(client.RemoteAddr()), edge.sid)
+	}
+	p.relay(edge, tun, edge.sid) // read edge
 }
 
 func (p *multiplexer) onTunDisconnected(tun *Conn, handler event_handler) {
-	p.router.cleanOfTun(tun)
 	if p.isClient {
 		p.pool.Remove(tun)
 	}
-	if handler != nil && p.status >= 0 {
+	// the resumable streams wait for re-attaching
+	if detached := p.router.cleanOfTun(tun); len(detached) > 0 && p.isClient && !p.closing() {
+		go p.migrate(detached)
+	}
+	if handler != nil && !p.closing() {
 		handler(evt_dt_closed, tun)
 	}
 }
 
-// TODO notify peer to slow down when queue increased too fast
 func (p *multiplexer) Listen(tun *Conn, handler event_handler, interval int) {
+	if obfs := p.conf().obfs; obfs != nil && tun.features&FEATURE_PADDING != 0 {
+		tun.obfs = obfs
+		if obfs.cover > 0 {
+			stop := make(chan bool)
+			defer close(stop)
+			go obfs.coverTraffic(tun, stop)
+		}
+	}
 	if p.isClient {
-		tun.priority = &TSPriority{0, 1e9}
 		p.pool.Push(tun)
 	}
 	defer p.onTunDisconnected(tun, handler)
 	tun.SetSockOpt(1, 1, 0)
 	var (
-		header     = make([]byte, FRAME_HEADER_LEN)
+		header     = make([]byte, tun.headerLen())
 		router     = p.router
 		idle       = NewIdler(interval, p.isClient)
 		lastActive = time.Now().Unix()
 		nr         int
 		er         error
 		now        int64
-		frm        *frame
+		frm        = new(frame) // reused, the queue holds its copy
 		key        string
+		held       = newBacklog(tun)
 	)
+	if p.isClient && idle.ping(tun) != nil { // measure rtt at first
+		return
+	}
 	for {
+		if held.paused() && p.resumeData(tun, held) != nil {
+			return
+		}
 		idle.newRound(tun)
-		nr, er = io.ReadFull(tun, header)
-		if nr == FRAME_HEADER_LEN {
-			frm = _parseFrameHeader(header)
+		nr, er = held.readFull(header, true)
+		if nr == 0 && er == nil {
+			continue // interrupted for resuming the data
+		}
+		if nr == len(header) {
+			_parseFrameHeader(header, frm)
 			if frm.length > 0 {
-				nr, er = io.ReadFull(tun, frm.data)
+				nr, er = held.readFull(frm.data, false)
 			}
 		}
 		if er != nil {
@@ -250,35 +322,52 @@ func (p *multiplexer) Listen(tun *Conn, handler event_handler, interval int) {
 			}
 			return // error, abandon tunnel
 		}
+		if frm.flags&FRAME_FLAG_COMPRESSED != 0 && tun.features&FEATURE_COMPRESS == 0 {
+			log.Errorln(p.mode, "Compressed frame without negotiation", frm, "from", tun.identifier)
+			return // protocol error
+		}
+		if p.isClient && idle.sampleDue() && idle.ping(tun) != nil {
+			return
+		}
 		key = sessionKey(tun, frm.sid)
 
 		switch frm.action {
-		case FRAME_ACTION_CLOSE_W:
-			if edge := router.getRegistered(key); edge != nil {
-				edge.closed |= TCP_CLOSE_W
-				edge.deliver(frm)
+		case FRAME_ACTION_CLOSE_W, FRAME_ACTION_DATA:
+			if held.paused() { // in order after the held data
+				held.hold(frm)
+			} else if p.onEdgeFrame(tun, key, frm) != nil {
+				return
+			} else if p.overQueued(tun) {
+				held.pause()
 			}
 		case FRAME_ACTION_CLOSE_R:
 			if edge := router.getRegistered(key); edge != nil {
-				edge.closed |= TCP_CLOSE_R
+				edge.setClosed(TCP_CLOSE_R)
 				closeR(edge.conn)
+				if edge.window != nil {
+					edge.window.close()
+				}
 			}
-		case FRAME_ACTION_DATA:
-			edge := router.getRegistered(key)
-			if edge == nil {
-				if log.V(2) {
-					log.Warningln("peer send data to an unexisted socket.", key, frm)
+		case FRAME_ACTION_SLOWDOWN:
+			if edge := router.getRegistered(key); edge != nil && edge.window != nil && frm.length == 4 {
+				edge.window.grant(int(binary.BigEndian.Uint32(frm.data)))
+				if edge.stream != nil {
+					edge.stream.ack(int(binary.BigEndian.Uint32(frm.data)))
 				}
-				// trigger sending close to notice peer.
-				_frame(header, FRAME_ACTION_CLOSE_R, frm.sid, nil)
+			}
+		case FRAME_ACTION_RESUME:
+			p.onResume(tun, key, frm)
+		case FRAME_ACTION_PADDING:
+		case FRAME_ACTION_OPEN:
+			if atomic.LoadInt32(&p.draining) > 0 { // refuse the new streams
+				_frame(header, len(header), FRAME_ACTION_OPEN_N, frm.sid, nil)
 				if tunWrite1(tun, header) != nil {
 					return
 				}
-			} else {
-				edge.deliver(frm)
+				break
 			}
-		case FRAME_ACTION_OPEN:
-			go p.connectToDest(frm, key, tun)
+			var open = *frm
+			go p.connectToDest(&open, key, tun)
 		case FRAME_ACTION_OPEN_N, FRAME_ACTION_OPEN_Y:
 			edge := router.getRegistered(key)
 			if edge == nil {
@@ -301,7 +390,7 @@ func (p *multiplexer) Listen(tun *Conn, handler event_handler, interval int) {
 				return
 			}
 		case FRAME_ACTION_PONG:
-			if !idle.verify() {
+			if !idle.verify(tun) {
 				log.Warningln("Incorrect action_pong received")
 			}
 		default:
@@ -313,13 +402,166 @@ func (p *multiplexer) Listen(tun *Conn, handler event_handler, interval int) {
 			lastActive = now
 			handler(evt_st_active, now)
 		}
-		if p.isClient {
-			tun.Update()
+	}
+}
+
+// the overflowed stream will be abandoned: tell peer to stop sending then close it.
+func (p *multiplexer) shed(edge *edgeConn, tun *Conn) error {
+	log.Warningf("%s shed stream(%s) queued over %s\n", p.mode, edge.dest, i64HumanSize(int64(p.conf().queueLimit)))
+	edge.setClosed(TCP_CLOSE_W)
+	edge.queue._shed()
+	var buf = make([]byte, tun.headerLen())
+	_frame(buf, len(buf), FRAME_ACTION_CLOSE_R, edge.sid, nil)
+	return tunWrite1(tun, buf)
+}
+
+// deliver the DATA or CLOSE_W to the edge, the error is fatal to the tun.
+func (p *multiplexer) onEdgeFrame(tun *Conn, key string, frm *frame) error {
+	edge := p.router.getRegistered(key)
+	if frm.action == FRAME_ACTION_CLOSE_W {
+		if edge != nil {
+			edge.setClosed(TCP_CLOSE_W)
+			edge.deliver(frm)
+		}
+		return nil
+	}
+	if edge == nil {
+		if log.V(2) {
+			log.Warningln("peer send data to an unexisted socket.", key, frm)
+		}
+		// trigger sending close to notice peer.
+		var buf = make([]byte, tun.headerLen())
+		_frame(buf, len(buf), FRAME_ACTION_CLOSE_R, frm.sid, nil)
+		return tunWrite1(tun, buf)
+	}
+	if edge.stream != nil && edge.getTun() != tun {
+		return nil // from the previous broken tun, has been retransmitted
+	}
+	if frm.flags&FRAME_FLAG_COMPRESSED != 0 {
+		if e := p.inflate(frm); e != nil {
+			log.Errorln(p.mode, "Inflate", frm, "from", tun.identifier)
+			return e
 		}
 	}
+	switch {
+	case !edge.deliver(frm):
+		return p.shed(edge, tun)
+	case edge.stream != nil:
+		edge.stream.received(int(frm.length))
+	}
+	return nil
 }
 
-func sessionKey(tun *Conn, sid uint16) string {
+func (p *multiplexer) overQueued(tun *Conn) bool {
+	limit := p.conf().queueLimit
+	return limit > 0 && atomic.LoadInt64(&tun.queued) > int64(limit*TUN_QUEUE_FACTOR)
+}
+
+// deliver the held frames after the queues were drained below the threshold,
+// or shed the heaviest stream if still blocked after timeout.
+func (p *multiplexer) resumeData(tun *Conn, held *backlog) error {
+	if p.overQueued(tun) {
+		if time.Since(held.since) < GENERAL_SO_TIMEOUT {
+			return nil
+		}
+		if edge := p.router.heaviestOfTun(tun); edge != nil {
+			if e := p.shed(edge, tun); e != nil {
+				return e
+			}
+		}
+	}
+	if log.V(3) {
+		log.Infof("%s resume data of tun(%s) held=%d\n", p.mode, tun.identifier, len(held.frames))
+	}
+	var frames = held.frames
+	held.reset()
+	for i, frm := range frames {
+		if e := p.onEdgeFrame(tun, sessionKey(tun, frm.sid), frm); e != nil {
+			return e
+		}
+		if p.overQueued(tun) {
+			held.pause()
+			for _, f := range frames[i+1:] {
+				held.hold(f)
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// the data path of tun is paused while its queues are over the threshold,
+// but the tun is still read for the control frames, eg. the pongs and the
+// credits, and the frames of data are held in order.
+type backlog struct {
+	tun    *Conn
+	frames []*frame
+	since  time.Time // zero if not paused
+	woken  int32     // the reading was interrupted for resuming
+}
+
+func newBacklog(tun *Conn) *backlog {
+	return &backlog{tun: tun}
+}
+
+func (b *backlog) paused() bool {
+	return !b.since.IsZero()
+}
+
+// interrupt the reading when the queues were drained or timeout
+func (b *backlog) pause() {
+	b.since = time.Now()
+	if log.V(3) {
+		log.Infof("pause data of tun(%s) queued=%d\n", b.tun.identifier, atomic.LoadInt64(&b.tun.queued))
+	}
+	go func() {
+		timer := time.NewTimer(GENERAL_SO_TIMEOUT)
+		defer timer.Stop()
+		select {
+		case <-b.tun.drained:
+		case <-timer.C:
+		}
+		atomic.StoreInt32(&b.woken, 1)
+		b.tun.SetReadDeadline(time.Now())
+	}()
+}
+
+func (b *backlog) hold(frm *frame) {
+	var f = *frm
+	f.data = append([]byte(nil), frm.data...)
+	b.frames = append(b.frames, &f)
+}
+
+func (b *backlog) reset() {
+	b.frames, b.since = nil, time.Time{}
+}
+
+// the timeout was caused by waking up
+func (b *backlog) interrupted(er error) bool {
+	if netErr, y := er.(net.Error); y && netErr.Timeout() && atomic.SwapInt32(&b.woken, 0) > 0 {
+		b.tun.SetReadDeadline(ZERO_TIME)
+		return true
+	}
+	return false
+}
+
+// the interruption only returns (0, nil) before the header of a frame,
+// and is ignored in the middle of a frame.
+func (b *backlog) readFull(buf []byte, head bool) (n int, er error) {
+	var nr int
+	for {
+		nr, er = io.ReadFull(b.tun, buf[n:])
+		n += nr
+		if er == nil || !b.interrupted(er) {
+			return
+		}
+		if head && n == 0 {
+			return 0, nil
+		}
+	}
+}
+
+func sessionKey(tun *Conn, sid uint32) string {
 	if tun.identifier != NULL {
 		return tun.identifier + "." + strconv.FormatUint(uint64(sid), 10)
 	} else {
@@ -335,8 +577,17 @@ func (p *multiplexer) connectToDest(frm *frame, key string, tun *Conn) {
 		dstConn net.Conn
 		err     error
 		target  = string(frm.data)
+		class   = PRIO_NORMAL
+		dialer  *outboundDialer
+		start   = time.Now()
 	)
-	dstConn, err = net.DialTimeout("tcp", target, GENERAL_SO_TIMEOUT)
+	if tun.features&FEATURE_PRIORITY != 0 && frm.length > 0 {
+		if class, target = int(frm.data[0]), target[1:]; class >= PRIO_CLASSES {
+			class = PRIO_NORMAL
+		}
+	}
+	dialer = p.conf().outbound.choose(tun.uid, target)
+	dstConn, err = dialer.dial(target, GENERAL_SO_TIMEOUT)
 	frm.length = 0
 	if err != nil {
 		log.Errorf("Cannot connect to [%s] for %s error: %s\n", target, key, err)
@@ -344,10 +595,23 @@ func (p *multiplexer) connectToDest(frm *frame, key string, tun *Conn) {
 		tunWrite2(tun, frm)
 	} else {
 		if log.V(1) {
-			log.Infoln("OPEN", target, "for", key)
+			var latency = time.Since(start) / time.Millisecond * time.Millisecond
+			if dialer.isDirect() {
+				log.Infof("OPEN %s(%s) for %s in %s\n", target, ipAddr(dstConn.RemoteAddr()), key, latency)
+			} else {
+				log.Infof("OPEN %s(%s) for %s in %s via %s\n", target, ipAddr(dstConn.RemoteAddr()), key, latency, dialer.desc)
+			}
 		}
 		dstConn.SetReadDeadline(ZERO_TIME)
-		edge := p.router.register(key, target, tun, dstConn, false) // write edge
+		edge := p.router.register(key, target, frm.sid, tun, dstConn) // write edge
+		if edge == nil {
+			log.Warningf("Refused OPEN %s for %s, the sid is in use\n", target, key)
+			SafeClose(dstConn)
+			frm.action = FRAME_ACTION_OPEN_N
+			tunWrite2(tun, frm)
+			return
+		}
+		edge.priority = class
 		frm.action = FRAME_ACTION_OPEN_Y
 		if tunWrite2(tun, frm) == nil {
 			p.relay(edge, tun, frm.sid) // read edge
@@ -357,19 +621,35 @@ func (p *multiplexer) connectToDest(frm *frame, key string, tun *Conn) {
 	}
 }
 
-func (p *multiplexer) relay(edge *edgeConn, tun *Conn, sid uint16) {
+func (p *multiplexer) relay(edge *edgeConn, tun *Conn, sid uint32) {
 	var (
+		hlen = tun.headerLen()
 		buf  = make([]byte, FRAME_MAX_LEN)
+		zbuf []byte
 		nr   int
 		er   error
 		code byte
 		src  = edge.conn
 	)
+	if edge.stream != nil {
+		edge.stream.count(true) // moved by migration
+	} else {
+		atomic.AddInt32(&tun.streams, 1)
+	}
 	defer func() {
-		if edge.closed&TCP_CLOSE_R == 0 { // only positively
-			_frame(buf, FRAME_ACTION_CLOSE_W, sid, nil)
-			tunWrite1(tun, buf[:FRAME_HEADER_LEN]) // tell peer to closeW
-			edge.closed |= TCP_CLOSE_R
+		if edge.stream != nil {
+			edge.stream.count(false)
+		} else {
+			atomic.AddInt32(&tun.streams, -1)
+		}
+		if edge.closedFlags()&TCP_CLOSE_R == 0 { // only positively
+			if edge.stream != nil && (code == FRAME_ACTION_OPEN_Y || !edge.positive) {
+				edge.stream.close()
+			} else {
+				_frame(buf, hlen, FRAME_ACTION_CLOSE_W, sid, nil)
+				tunWrite1(tun, buf[:hlen]) // tell peer to closeW
+			}
+			edge.setClosed(TCP_CLOSE_R)
 		}
 		if code == FRAME_ACTION_OPEN_Y {
 			closeR(src)
@@ -378,28 +658,41 @@ func (p *multiplexer) relay(edge *edgeConn, tun *Conn, sid uint16) {
 		}
 	}()
 	if edge.positive { // for client:
-		// new connection must send OPEN first.
-		_len := _frame(buf, FRAME_ACTION_OPEN, sid, []byte(edge.dest))
-		if tunWrite1(tun, buf[:_len]) != nil {
-			SafeClose(tun)
-			return
-		}
-		select {
-		case code = <-edge.ready:
-			edge.initEqueue() // client delayed starting queue
-		case <-time.After(WAITING_OPEN_TIMEOUT):
-			log.Errorf("waiting open-signal(sid=%d) timeout for %s\n", sid, edge.dest)
-		}
-		if code != FRAME_ACTION_OPEN_Y {
+		if code = p.open(edge, tun, buf); code != FRAME_ACTION_OPEN_Y {
 			return
 		}
 	}
 	for {
-		nr, er = src.Read(buf[FRAME_HEADER_LEN:])
-		if nr > 0 {
-			_frame(buf, FRAME_ACTION_DATA, sid, uint16(nr))
-			nr += FRAME_HEADER_LEN
-			if tunWrite1(tun, buf[:nr]) != nil {
+		var size = FRAME_MAX_LEN - hlen
+		if tun.obfs != nil {
+			size = tun.obfs.frameSize(size)
+		}
+		if edge.window != nil {
+			// waiting for the credit granted by peer
+			if size = edge.window.acquire(size); size <= 0 {
+				return
+			}
+		}
+		nr, er = src.Read(buf[hlen : hlen+size])
+		if edge.window != nil && nr < size { // give back the unused
+			edge.window.grant(size - nr)
+		}
+		if nr > 0 && edge.stream != nil {
+			// the broken tun will be replaced by migration
+			edge.stream.write(buf[hlen : hlen+nr])
+		} else if nr > 0 && edge.compressor != nil {
+			if zbuf == nil {
+				zbuf = make([]byte, FRAME_MAX_LEN)
+			}
+			nr = p.dataFrame(zbuf, hlen, sid, buf[hlen:hlen+nr], edge.compressor)
+			if tunWriteP(tun, zbuf[:nr], edge.priority) != nil {
+				SafeClose(tun)
+				return
+			}
+		} else if nr > 0 {
+			_frame(buf, hlen, FRAME_ACTION_DATA, sid, uint16(nr))
+			nr += hlen
+			if tunWriteP(tun, buf[:nr], edge.priority) != nil {
 				SafeClose(tun)
 				return
 			}
@@ -410,7 +703,65 @@ func (p *multiplexer) relay(edge *edgeConn, tun *Conn, sid uint16) {
 	}
 }
 
-func tunWrite1(tun *Conn, buf []byte) (err error) {
+// new connection must send OPEN first, returns OPEN_Y/N or 0 if failed.
+func (p *multiplexer) open(edge *edgeConn, tun *Conn, buf []byte) (code byte) {
+	var open = []byte(edge.dest)
+	if tun.features&FEATURE_PRIORITY != 0 {
+		open = append([]byte{byte(edge.priority)}, open...)
+	}
+	_len := _frame(buf, tun.headerLen(), FRAME_ACTION_OPEN, edge.sid, open)
+	if tunWrite1(tun, buf[:_len]) != nil {
+		SafeClose(tun)
+		return
+	}
+	select {
+	case code = <-edge.ready:
+		edge.initEqueue() // client delayed starting queue
+	case <-time.After(WAITING_OPEN_TIMEOUT):
+		log.Errorf("waiting open-signal(sid=%d) timeout for %s\n", edge.sid, edge.dest)
+	}
+	return
+}
+
+// frame the data into buf, the payload will be compressed if worth.
+func (p *multiplexer) dataFrame(buf []byte, hlen int, sid uint32, data []byte, c *compressor) int {
+	if c != nil {
+		if n := c.compress(buf[hlen:], data); n > 0 {
+			atomic.AddInt64(&p.saved, int64(len(data)-n))
+			return _frame(buf, hlen, FRAME_ACTION_DATA|FRAME_FLAG_COMPRESSED, sid, uint16(n))
+		}
+	}
+	return _frame(buf, hlen, FRAME_ACTION_DATA, sid, data)
+}
+
+func (p *multiplexer) inflate(frm *frame) error {
+	data, err := inflate(frm.data)
+	if err != nil {
+		return err
+	}
+	frm.data, frm.length = data, uint16(len(data))
+	return nil
+}
+
+// the control frames take precedence over data
+func tunWrite1(tun *Conn, buf []byte) error {
+	return tunWriteP(tun, buf, PRIO_HIGH)
+}
+
+// write in the turn given by the scheduler of tun
+func tunWriteP(tun *Conn, buf []byte, class int) (err error) {
+	if tun.obfs != nil {
+		buf = tun.obfs.pad(buf, tun.headerLen())
+	}
+	return _tunWrite(tun, buf, class)
+}
+
+// write without padding
+func _tunWrite(tun *Conn, buf []byte, class int) (err error) {
+	if tun.sched != nil {
+		tun.sched.acquire(class, len(buf))
+		defer tun.sched.release()
+	}
 	err = tun.SetWriteDeadline(time.Now().Add(GENERAL_SO_TIMEOUT * 2))
 	if err != nil {
 		return
@@ -427,13 +778,23 @@ func tunWrite1(tun *Conn, buf []byte) (err error) {
 }
 
 func tunWrite2(tun *Conn, frm *frame) (err error) {
+	var (
+		nr, nw int
+		buf    = frm.toNewBuffer(tun.headerLen())
+	)
+	if tun.obfs != nil {
+		buf = tun.obfs.pad(buf, tun.headerLen())
+	}
+	if tun.sched != nil {
+		tun.sched.acquire(PRIO_HIGH, len(buf))
+		defer tun.sched.release()
+	}
 	err = tun.SetWriteDeadline(time.Now().Add(GENERAL_SO_TIMEOUT * 2))
 	if err != nil {
 		return
 	}
-	var nr, nw int
-	nr = int(frm.length) + FRAME_HEADER_LEN
-	nw, err = tun.Write(frm.toNewBuffer())
+	nr = len(buf)
+	nw, err = tun.Write(buf)
 	if nr != nw || err != nil {
 		log.Warningf("Write tun(%s) error(%v) when sending %s\n", tun.sign(), err, frm)
 		SafeClose(tun)
@@ -442,50 +803,52 @@ func tunWrite2(tun *Conn, frm *frame) (err error) {
 	return nil
 }
 
-func _nextSID() uint16 {
-	seqLock.Lock()
-	defer seqLock.Unlock()
-	SID_SEQ += 1
-	if SID_SEQ > 0xffff {
-		SID_SEQ = 1
+func _parseFrameHeader(header []byte, f *frame) {
+	f.action = header[0]
+	f.flags = 0
+	if f.action != FRAME_ACTION_SLOWDOWN && f.action&FRAME_FLAG_COMPRESSED != 0 {
+		f.action &^= FRAME_FLAG_COMPRESSED
+		f.flags = FRAME_FLAG_COMPRESSED
 	}
-	return uint16(SID_SEQ)
-}
-
-func _parseFrameHeader(header []byte) *frame {
-	f := &frame{
-		header[0],
-		binary.BigEndian.Uint16(header[1:]),
-		binary.BigEndian.Uint16(header[3:]),
-		nil, nil,
+	if len(header) == FRAME_HEADER_LEN32 {
+		f.sid = binary.BigEndian.Uint32(header[1:])
+	} else {
+		f.sid = uint32(binary.BigEndian.Uint16(header[1:]))
 	}
+	f.length = binary.BigEndian.Uint16(header[len(header)-2:])
+	f.conn = nil
 	if f.length > 0 {
 		f.data = make([]byte, f.length)
+	} else {
+		f.data = nil
 	}
-	return f
 }
 
-func _frame(buf []byte, action byte, sid uint16, body_or_len interface{}) int {
-	var _len = FRAME_HEADER_LEN
+func _frame(buf []byte, hlen int, action byte, sid uint32, body_or_len interface{}) int {
+	var _len = hlen
 	buf[0] = action
-	binary.BigEndian.PutUint16(buf[1:], sid)
+	if hlen == FRAME_HEADER_LEN32 {
+		binary.BigEndian.PutUint32(buf[1:], sid)
+	} else {
+		binary.BigEndian.PutUint16(buf[1:], uint16(sid))
+	}
 	if body_or_len != nil {
 		switch body_or_len.(type) {
 		case []byte:
 			body := body_or_len.([]byte)
 			_len += len(body)
-			binary.BigEndian.PutUint16(buf[3:], uint16(len(body)))
-			copy(buf[FRAME_HEADER_LEN:], body)
+			binary.BigEndian.PutUint16(buf[hlen-2:], uint16(len(body)))
+			copy(buf[hlen:], body)
 		case uint16:
 			blen := body_or_len.(uint16)
 			_len += int(blen)
-			binary.BigEndian.PutUint16(buf[3:], blen)
+			binary.BigEndian.PutUint16(buf[hlen-2:], blen)
 		default:
 			panic("unknown body_or_len")
 		}
 	} else {
-		buf[3] = 0
-		buf[4] = 0
+		buf[hlen-2] = 0
+		buf[hlen-1] = 0
 	}
 	return _len
 }
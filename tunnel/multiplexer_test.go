@@ -8,9 +8,11 @@ import (
 	log "github.com/spance/deblocus/golang/glog"
 	"io"
 	"net"
+	"os"
 	"reflect"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -106,6 +108,13 @@ func startClient(size int) {
 	}
 }
 
+// as negotiated with all features
+func newTestConn(conn net.Conn) *Conn {
+	c := NewConn(conn.(*net.TCPConn), nil)
+	c.features = LOCAL_FEATURES
+	return c
+}
+
 func randomBuffer(buf []byte) (n uint16) {
 	step := 32
 	io.ReadFull(rand.Reader, buf[:step])
@@ -196,3 +205,136 @@ func TestConcurrency(t *testing.T) {
 	rest(3)
 	checkFinishedLength(t)
 }
+
+// the streams exceeding the window through the tun with negotiated features
+func TestNegotiatedFeatures(t *testing.T) {
+	echo := listenLocal(t, func(conn net.Conn) {
+		io.Copy(conn, conn)
+		conn.Close()
+	})
+	defer echo.Close()
+	var (
+		svr = NewServerMultiplexer()
+		clt = NewClientMultiplexer()
+	)
+	defer clt.router.stopCleanTask()
+	defer svr.router.stopCleanTask()
+	svrLn := listenLocal(t, func(conn net.Conn) {
+		svr.Listen(newTestConn(conn), nil, 0)
+	})
+	defer svrLn.Close()
+	conn, e := net.Dial("tcp", svrLn.Addr().String())
+	if e != nil {
+		t.Fatal(e)
+	}
+	go clt.Listen(newTestConn(conn), nil, 0)
+	for clt.pool.Len() < 1 {
+		rest(-1)
+	}
+	front := listenLocal(t, func(conn net.Conn) {
+		clt.HandleRequest("T", conn, echo.Addr().String())
+	})
+	defer front.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(j int) {
+			defer wg.Done()
+			conn, e := net.Dial("tcp", front.Addr().String())
+			if e != nil {
+				t.Error(e)
+				return
+			}
+			defer conn.Close()
+			var (
+				sent = make([]byte, STREAM_WINDOW_SIZE*2)
+				recv = make([]byte, len(sent))
+			)
+			io.ReadFull(rand.Reader, sent)
+			go conn.Write(sent)
+			if _, e = io.ReadFull(conn, recv); e != nil || !bytes.Equal(sent, recv) {
+				t.Errorf("thread=%d sent != recv %v", j, e)
+			}
+		}(i)
+	}
+	wg.Wait()
+	rest(3)
+	svr.router.clean()
+	clt.router.clean()
+	assertLength(t, "server.registry", svr.router.registry, 0, "client.registry", clt.router.registry, 0)
+}
+
+func Test_drain(t *testing.T) {
+	echo := listenLocal(t, func(conn net.Conn) {
+		io.Copy(conn, conn)
+		conn.Close()
+	})
+	defer echo.Close()
+	var (
+		svr = NewServerMultiplexer()
+		clt = NewClientMultiplexer()
+	)
+	defer clt.router.stopCleanTask()
+	svrLn := listenLocal(t, func(conn net.Conn) {
+		svr.Listen(newTestConn(conn), nil, 0)
+	})
+	defer svrLn.Close()
+	conn, e := net.Dial("tcp", svrLn.Addr().String())
+	if e != nil {
+		t.Fatal(e)
+	}
+	go clt.Listen(newTestConn(conn), nil, 0)
+	for clt.pool.Len() < 1 {
+		rest(-1)
+	}
+	front := listenLocal(t, func(conn net.Conn) {
+		clt.HandleRequest("T", conn, echo.Addr().String())
+	})
+	defer front.Close()
+	if conn, e = net.Dial("tcp", front.Addr().String()); e != nil {
+		t.Fatal(e)
+	}
+	var buf = []byte("ping")
+	conn.Write(buf)
+	if _, e = io.ReadFull(conn, buf); e != nil {
+		t.Fatal(e)
+	}
+	for svr.router.live() < 1 {
+		rest(-1)
+	}
+	var (
+		drained  = make(chan int, 1)
+		finished int32
+	)
+	go func() {
+		cut := svr.drain(time.Second * 5)
+		if atomic.LoadInt32(&finished) == 0 {
+			cut = -1 // returned with the live stream
+		}
+		drained <- cut
+	}()
+	for atomic.LoadInt32(&svr.draining) == 0 {
+		rest(-1)
+	}
+	// the new stream is refused
+	refused, e := net.Dial("tcp", front.Addr().String())
+	if e != nil {
+		t.Fatal(e)
+	}
+	refused.Write(buf)
+	refused.SetReadDeadline(time.Now().Add(time.Second * 2))
+	if _, e = refused.Read(buf); e == nil || os.IsTimeout(e) {
+		t.Fatalf("opened while draining %v", e)
+	}
+	refused.Close()
+	atomic.StoreInt32(&finished, 1)
+	conn.Close() // the stream finished
+	select {
+	case cut := <-drained:
+		if cut != 0 {
+			t.Fatalf("cut %d streams", cut)
+		}
+	case <-time.After(time.Second * 4):
+		t.Fatalf("drain timeout")
+	}
+}
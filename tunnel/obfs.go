@@ -0,0 +1,105 @@
+package tunnel
+
+import (
+	"github.com/spance/deblocus/exception"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+const (
+	OBFS_OFF     = "off"
+	OBFS_PADDING = "padding"
+	OBFS_COVER   = "cover="
+	// every writing will be followed by a padding frame in random length
+	PADDING_MAX_LEN = 1024
+	// the DATA frames will be read in random size not less than
+	OBFS_FRAME_MIN = 512
+	// body length of cover frames
+	COVER_FRAME_MAX = 4096
+)
+
+var (
+	INVALID_OBFUSCATION = exception.NewW("Invalid obfuscation")
+)
+
+// the obfuscator hides the length of frames and the idle period of tun,
+// the padding frames will be dropped by peer.
+type obfuscator struct {
+	cover int // bytes per second of cover traffic, 0 for disabled
+}
+
+// off | padding | padding,cover=16K
+func parseObfuscation(literal string) (*obfuscator, error) {
+	literal = strings.TrimSpace(literal)
+	if literal == NULL || literal == OBFS_OFF {
+		return nil, nil
+	}
+	items := strings.Split(literal, ",")
+	if strings.TrimSpace(items[0]) != OBFS_PADDING {
+		return nil, INVALID_OBFUSCATION.Apply(literal)
+	}
+	o := new(obfuscator)
+	for _, item := range items[1:] {
+		item = strings.TrimSpace(item)
+		if !strings.HasPrefix(item, OBFS_COVER) {
+			return nil, INVALID_OBFUSCATION.Apply(item)
+		}
+		rate, e := parseHumanSize(item[len(OBFS_COVER):])
+		if e != nil || rate <= 0 {
+			return nil, INVALID_OBFUSCATION.Apply(item)
+		}
+		o.cover = rate
+	}
+	return o, nil
+}
+
+// append a padding frame to buf in its headroom if enough, or a new buffer.
+// the body of padding is whatever left in buf, it will be encrypted anyway.
+func (o *obfuscator) pad(buf []byte, hlen int) []byte {
+	var (
+		n   = rand.Intn(PADDING_MAX_LEN - hlen)
+		end = len(buf) + hlen + n
+		out []byte
+	)
+	if end <= cap(buf) {
+		out = buf[:end]
+	} else {
+		out = make([]byte, end)
+		copy(out, buf)
+	}
+	_frame(out[len(buf):], hlen, FRAME_ACTION_PADDING, 0, uint16(n))
+	return out
+}
+
+// random reading size in [OBFS_FRAME_MIN, max]
+func (o *obfuscator) frameSize(max int) int {
+	if max <= OBFS_FRAME_MIN {
+		return max
+	}
+	return int(randomRange(OBFS_FRAME_MIN, int64(max)+1))
+}
+
+// send padding frames at the rate until stop or failed.
+func (o *obfuscator) coverTraffic(tun *Conn, stop chan bool) {
+	var (
+		hlen = tun.headerLen()
+		buf  = make([]byte, hlen+COVER_FRAME_MAX)
+	)
+	for {
+		n := rand.Intn(COVER_FRAME_MAX)
+		// jitter in [0.5, 1.5) of the interval at the rate
+		interval := time.Duration(n+hlen) * time.Second / time.Duration(o.cover)
+		interval = interval/2 + time.Duration(rand.Int63n(int64(interval)+1))
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+		// the cover frame is a padding already
+		_frame(buf, hlen, FRAME_ACTION_PADDING, 0, uint16(n))
+		if _tunWrite(tun, buf[:hlen+n], PRIO_BULK) != nil {
+			return
+		}
+	}
+}
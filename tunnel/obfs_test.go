@@ -0,0 +1,125 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_parseObfuscation(t *testing.T) {
+	for _, off := range []string{"", "off"} {
+		if o, e := parseObfuscation(off); o != nil || e != nil {
+			t.Fatalf("%q => %v %v", off, o, e)
+		}
+	}
+	if o, e := parseObfuscation("padding, cover=16K"); e != nil || o.cover != 16<<10 {
+		t.Fatalf("padding => %v %v", o, e)
+	}
+	for _, bad := range []string{"on", "padding,cover=", "padding,rate=1K"} {
+		if _, e := parseObfuscation(bad); e == nil {
+			t.Fatalf("%q was accepted", bad)
+		}
+	}
+}
+
+func Test_obfuscatedStream(t *testing.T) {
+	echo := listenLocal(t, func(conn net.Conn) {
+		io.Copy(conn, conn)
+		conn.Close()
+	})
+	defer echo.Close()
+	var (
+		obfs = &obfuscator{cover: 64 << 10}
+		svr  = NewServerMultiplexer()
+		clt  = NewClientMultiplexer()
+		tun  *Conn
+	)
+	svr.configure(&muxSettings{queueLimit: EQUEUE_LIMIT, obfs: obfs})
+	clt.configure(&muxSettings{queueLimit: EQUEUE_LIMIT, obfs: obfs})
+	defer svr.router.stopCleanTask()
+	defer clt.router.stopCleanTask()
+	svrLn := listenLocal(t, func(conn net.Conn) {
+		svr.Listen(newTestConn(conn), nil, 0)
+	})
+	defer svrLn.Close()
+	conn, e := net.Dial("tcp", svrLn.Addr().String())
+	if e != nil {
+		t.Fatal(e)
+	}
+	tun = newTestConn(conn)
+	go clt.Listen(tun, nil, 0)
+	defer tun.Close()
+	for clt.pool.Len() < 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// cover traffic while idle
+	time.Sleep(200 * time.Millisecond)
+	if n := atomic.LoadInt64(&tun.traffic); n == 0 {
+		t.Fatalf("no cover traffic")
+	}
+
+	front := listenLocal(t, func(conn net.Conn) {
+		clt.HandleRequest("T", conn, echo.Addr().String())
+	})
+	defer front.Close()
+	if conn, e = net.Dial("tcp", front.Addr().String()); e != nil {
+		t.Fatal(e)
+	}
+	defer conn.Close()
+	var (
+		sent = make([]byte, 256<<10)
+		recv = make([]byte, len(sent))
+	)
+	io.ReadFull(rand.Reader, sent)
+	go conn.Write(sent)
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, e = io.ReadFull(conn, recv); e != nil {
+		t.Fatal(e)
+	}
+	if !bytes.Equal(sent, recv) {
+		t.Fatalf("stream was corrupted by padding")
+	}
+}
+
+func Test_obfsPad(t *testing.T) {
+	var (
+		o    = new(obfuscator)
+		hlen = FRAME_HEADER_LEN
+		buf  = make([]byte, 100, 100+PADDING_MAX_LEN)
+	)
+	out := o.pad(buf, hlen)
+	if &out[0] != &buf[0] {
+		t.Fatalf("not padded in headroom")
+	}
+	var frm frame
+	_parseFrameHeader(out[len(buf):len(buf)+hlen], &frm)
+	if frm.action != FRAME_ACTION_PADDING || len(out) != len(buf)+hlen+int(frm.length) {
+		t.Fatalf("padding %s in %d", &frm, len(out))
+	}
+	if out = o.pad(buf[:100:100], hlen); &out[0] == &buf[0] || len(out) < 100+hlen {
+		t.Fatalf("padded without headroom len=%d", len(out))
+	}
+}
+
+func Test_idlerSample(t *testing.T) {
+	i := &idler{enabled: true, interval: time.Minute}
+	if !i.sampleDue() {
+		t.Fatalf("never sampled")
+	}
+	i.waiting, i.pingTime = true, time.Now().Add(-time.Hour)
+	if i.sampleDue() {
+		t.Fatalf("sampled while waiting pong")
+	}
+	i.waiting = false
+	if !i.sampleDue() {
+		t.Fatalf("not sampled after interval")
+	}
+	i.pingTime = time.Now()
+	if i.sampleDue() {
+		t.Fatalf("sampled in interval")
+	}
+}
@@ -0,0 +1,244 @@
+package tunnel
+
+import (
+	"github.com/spance/deblocus/exception"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	OUTBOUND_DIRECT = "direct"
+	OUTBOUND_BIND   = "bind:"
+	OUTBOUND_IFACE  = "iface:"
+	MATCH_USER      = "user:"
+	MATCH_DEST      = "dest:"
+	MATCH_ANY       = "*"
+)
+
+var (
+	INVALID_OUTBOUND = exception.NewW("Invalid outbound rule")
+)
+
+// how to establish the connection to destination on server
+type outboundDialer struct {
+	desc  string
+	proxy *upstreamProxy
+	local net.IP
+	iface string
+}
+
+func parseOutboundDialer(literal string) (*outboundDialer, error) {
+	var d = &outboundDialer{desc: literal}
+	switch {
+	case literal == OUTBOUND_DIRECT:
+	case strings.HasPrefix(literal, OUTBOUND_BIND):
+		if d.local = net.ParseIP(literal[len(OUTBOUND_BIND):]); d.local == nil {
+			return nil, INVALID_OUTBOUND.Apply(literal)
+		}
+	case strings.HasPrefix(literal, OUTBOUND_IFACE):
+		if d.iface = literal[len(OUTBOUND_IFACE):]; d.iface == NULL {
+			return nil, INVALID_OUTBOUND.Apply(literal)
+		}
+	case strings.Contains(literal, "://"):
+		var e error
+		if d.proxy, e = parseUpstreamProxy(literal); e != nil {
+			return nil, e
+		}
+	default:
+		return nil, INVALID_OUTBOUND.Apply(literal)
+	}
+	return d, nil
+}
+
+func (d *outboundDialer) isDirect() bool {
+	return d == nil || d.desc == OUTBOUND_DIRECT
+}
+
+// source addresses of each family
+func (d *outboundDialer) sources() (v4, v6 net.IP, err error) {
+	var candidates []net.IP
+	if d.iface != NULL {
+		ifi, e := net.InterfaceByName(d.iface)
+		if e != nil {
+			return nil, nil, e
+		}
+		addrs, e := ifi.Addrs()
+		if e != nil {
+			return nil, nil, e
+		}
+		for _, a := range addrs {
+			if n, y := a.(*net.IPNet); y && !n.IP.IsLinkLocalUnicast() {
+				candidates = append(candidates, n.IP)
+			}
+		}
+	} else {
+		candidates = []net.IP{d.local}
+	}
+	for _, ip := range candidates {
+		if ip.To4() != nil {
+			if v4 == nil {
+				v4 = ip
+			}
+		} else if v6 == nil {
+			v6 = ip
+		}
+	}
+	return
+}
+
+// resolve by the caching resolver then dial with happy eyeballs.
+// the bound dialer only uses the addresses in family of its sources.
+func (d *outboundDialer) dial(target string, timeout time.Duration) (net.Conn, error) {
+	if d != nil && d.proxy != nil {
+		return d.proxy.dial(target, timeout)
+	}
+	host, port, e := net.SplitHostPort(target)
+	if e != nil {
+		return nil, e
+	}
+	ips, e := defaultResolver.lookup(host)
+	if e != nil {
+		return nil, e
+	}
+	var localAddr func(net.IP) net.Addr
+	if !d.isDirect() {
+		v4, v6, e := d.sources()
+		if e != nil {
+			return nil, e
+		}
+		var available []net.IP
+		for _, ip := range ips {
+			if ip.To4() != nil && v4 != nil || ip.To4() == nil && v6 != nil {
+				available = append(available, ip)
+			}
+		}
+		if len(available) == 0 {
+			return nil, INVALID_OUTBOUND.Apply("no suitable source address by " + d.desc)
+		}
+		ips = available
+		localAddr = func(ip net.IP) net.Addr {
+			if ip.To4() != nil {
+				return &net.TCPAddr{IP: v4}
+			}
+			return &net.TCPAddr{IP: v6}
+		}
+	}
+	return happyDial(sortByFamily(ips), port, timeout, localAddr)
+}
+
+type outboundRule struct {
+	user   string
+	domain string
+	cidr   *net.IPNet
+	dialer *outboundDialer
+}
+
+// the cidr matches the domain target with its resolved addresses
+func (r *outboundRule) match(uid, host string, resolved func() []net.IP) bool {
+	switch {
+	case r.user != NULL:
+		return r.user == uid
+	case r.cidr != nil && net.ParseIP(host) == nil:
+		for _, ip := range resolved() {
+			if r.cidr.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	case r.cidr != nil || r.domain != NULL:
+		return matchDest(r.domain, r.cidr, host)
+	}
+	return true
+}
+
+// ordered rules, the first matched will be chosen.
+// [user:NAME|dest:DOMAIN|dest:CIDR|*=](direct|bind:IP|iface:NAME|socks5://..|http://..);...
+type outboundPolicy []*outboundRule
+
+func parseOutboundPolicy(literal string) (outboundPolicy, error) {
+	var policy outboundPolicy
+	for _, item := range strings.Split(literal, ";") {
+		item = strings.TrimSpace(item)
+		if item == NULL {
+			continue
+		}
+		var matcher, egress = MATCH_ANY, item
+		if eq := strings.Index(item, "="); eq > 0 && !strings.Contains(item[:eq], "://") {
+			matcher, egress = strings.TrimSpace(item[:eq]), strings.TrimSpace(item[eq+1:])
+		}
+		dialer, e := parseOutboundDialer(egress)
+		if e != nil {
+			return nil, e
+		}
+		rule := &outboundRule{dialer: dialer}
+		switch {
+		case matcher == MATCH_ANY:
+		case strings.HasPrefix(matcher, MATCH_USER):
+			rule.user = matcher[len(MATCH_USER):]
+		case strings.HasPrefix(matcher, MATCH_DEST):
+			if rule.domain, rule.cidr, e = parseDestMatcher(matcher[len(MATCH_DEST):]); e != nil {
+				return nil, INVALID_OUTBOUND.Apply(e)
+			}
+		default:
+			return nil, INVALID_OUTBOUND.Apply(item)
+		}
+		if rule.user == NULL && rule.cidr == nil && rule.domain == NULL && matcher != MATCH_ANY {
+			return nil, INVALID_OUTBOUND.Apply(item)
+		}
+		policy = append(policy, rule)
+	}
+	return policy, nil
+}
+
+// DOMAIN, *.DOMAIN, IP or CIDR
+func parseDestMatcher(dest string) (domain string, cidr *net.IPNet, e error) {
+	dest = strings.ToLower(dest)
+	if strings.Contains(dest, "/") {
+		_, cidr, e = net.ParseCIDR(dest)
+	} else if ip := net.ParseIP(dest); ip != nil {
+		bits := 8 * len(ip.To16())
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		cidr = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	} else {
+		domain = strings.TrimPrefix(dest, "*.")
+	}
+	return
+}
+
+func matchDest(domain string, cidr *net.IPNet, host string) bool {
+	if cidr != nil {
+		ip := net.ParseIP(host)
+		return ip != nil && cidr.Contains(ip)
+	}
+	host = strings.ToLower(host)
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// nil policy means direct
+func (p outboundPolicy) choose(uid, target string) *outboundDialer {
+	host, _, e := net.SplitHostPort(target)
+	if e != nil {
+		host = target
+	}
+	var (
+		ips    []net.IP
+		lookup bool
+	)
+	// resolved once by the first cidr rule, then cached for dialing
+	var resolved = func() []net.IP {
+		if !lookup {
+			lookup = true
+			ips, _ = defaultResolver.lookup(host)
+		}
+		return ips
+	}
+	for _, r := range p {
+		if r.match(uid, host, resolved) {
+			return r.dialer
+		}
+	}
+	return nil
+}
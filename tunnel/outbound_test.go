@@ -0,0 +1,33 @@
+package tunnel
+
+import (
+	"testing"
+)
+
+func Test_outboundPolicy(t *testing.T) {
+	policy, e := parseOutboundPolicy("user:alice=socks5://u:p@10.0.0.1:1080; dest:*.example.com=bind:192.0.2.1; dest:10.0.0.0/8=direct; dest:127.0.0.0/8=bind:127.0.0.1; iface:eth1")
+	if e != nil {
+		t.Fatal(e)
+	}
+	var cases = [][3]string{
+		{"alice", "www.example.com:443", "socks5://u:p@10.0.0.1:1080"},
+		{"bob", "www.example.com:443", "bind:192.0.2.1"},
+		{"bob", "example.com:80", "bind:192.0.2.1"},
+		{"bob", "10.1.2.3:22", "direct"},
+		{"bob", "localhost:22", "bind:127.0.0.1"}, // resolved by hosts
+		{"bob", "badexample.com:80", "iface:eth1"},
+	}
+	for _, c := range cases {
+		if d := policy.choose(c[0], c[1]); d == nil || d.desc != c[2] {
+			t.Errorf("%s -> %s chose %v", c[0], c[1], d)
+		}
+	}
+	if d := outboundPolicy(nil).choose("bob", "example.com:80"); !d.isDirect() {
+		t.Errorf("nil policy chose %v", d)
+	}
+	for _, literal := range []string{"user:=direct", "dest:10.0.0.0/33=direct", "ftp://a:21", "bind:x", "host:a=direct"} {
+		if _, e := parseOutboundPolicy(literal); e == nil {
+			t.Errorf("%s should be invalid", literal)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package tunnel
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	ENV_PREFIX = "DEBLOCUS_"
+	// where the value of field came from, the later overrides the former.
+	SOURCE_DEFAULT = "default"
+	SOURCE_FILE    = "file"
+	SOURCE_ENV     = "env"
+	SOURCE_FLAG    = "flag"
+)
+
+var (
+	// Field=Value of command line
+	flagOverrides []string
+	// the password of proxy uri
+	uriPassword = regexp.MustCompile(`(://[^:@/\s;]*:)[^@/\s;]*@`)
+)
+
+func SetOverride(literal string) error {
+	if eq := strings.Index(literal, "="); eq > 0 {
+		flagOverrides = append(flagOverrides, literal)
+		return nil
+	}
+	return CONF_ERROR.Apply("expected Field=Value but " + literal)
+}
+
+type confOverride struct {
+	field  string
+	value  string
+	source string
+	origin string // env name or flag
+}
+
+// the invalid value is reported with the env or flag
+func (o *confOverride) set(d *FieldDescriptor) {
+	defer func() {
+		if e := recover(); e != nil {
+			panic(CONF_ERROR.Apply(fmt.Sprintf("%s=%s %v", o.origin, maskCredentials(o.value), e)))
+		}
+	}()
+	d.set(o.value)
+}
+
+// returns the first problem, and the problem of the overridden field is
+// attributed to the env or flag.
+func validateAt(check func(report func(field string, e error)), origins map[string]string) (first error) {
+	check(func(field string, e error) {
+		if first != nil {
+			return
+		}
+		if origin, y := origins[field]; y {
+			e = CONF_ERROR.Apply(origin + " " + e.Error())
+		}
+		first = e
+	})
+	return
+}
+
+func maskCredentials(v string) string {
+	return uriPassword.ReplaceAllString(v, "${1}***@")
+}
+
+// DEBLOCUS_<FIELD> of environment, then -set Field=Value in order.
+func getOverrides(desc ImportableFieldDesc) ([]*confOverride, error) {
+	var (
+		overrides []*confOverride
+		names     = make([]string, 0, len(desc))
+	)
+	for name := range desc {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		env := ENV_PREFIX + strings.ToUpper(name)
+		if v, y := os.LookupEnv(env); y {
+			overrides = append(overrides, &confOverride{name, v, SOURCE_ENV, env})
+		}
+	}
+	for _, literal := range flagOverrides {
+		var (
+			eq    = strings.Index(literal, "=")
+			field string
+		)
+		for _, name := range names {
+			if strings.EqualFold(name, literal[:eq]) {
+				field = name
+			}
+		}
+		if field == NULL {
+			return overrides, UNRECOGNIZED_DIRECTIVES.Apply("-set " + literal)
+		}
+		overrides = append(overrides, &confOverride{field, literal[eq+1:], SOURCE_FLAG, "-set " + field})
+	}
+	return overrides, nil
+}
+
+// the effective values of the importable fields and where they came from,
+// the passwords are masked.
+func DumpConf(path string, isServ bool) string {
+	var instance interface{} = new(D5ClientConf)
+	if isServ {
+		instance = new(D5ServConf)
+	}
+	var (
+		desc       = getImportableDesc(instance)
+		sources, _ = parseD5ConfFile(path, desc, func([]byte) {})
+		names      = make([]string, 0, len(desc))
+		buf        = new(bytes.Buffer)
+	)
+	for name := range desc {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		source := sources[name]
+		if source == NULL {
+			source = SOURCE_DEFAULT
+		}
+		value := maskCredentials(fmt.Sprint(desc[name].fValue.Interface()))
+		if value == NULL {
+			value = `""`
+		}
+		fmt.Fprintf(buf, "%-16s   %-32s # %s\n", name, value, source)
+	}
+	return buf.String()
+}
@@ -0,0 +1,104 @@
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	PAC_PATH         = "/proxy.pac"
+	WPAD_PATH        = "/wpad.dat"
+	PAC_CONTENT_TYPE = "application/x-ns-proxy-autoconfig"
+)
+
+// proxy auto-config script generated from the domain list of client config
+type pacFile struct {
+	domains []string
+}
+
+// the source could be an inline list separated by space or comma,
+// or a file indicated by file:///path containing one domain per line.
+func newPACFile(source string) (*pacFile, error) {
+	var words []string
+	if strings.HasPrefix(source, "file://") {
+		f, e := os.Open(source[7:])
+		if e != nil {
+			return nil, e
+		}
+		defer f.Close()
+		r := bufio.NewScanner(f)
+		for r.Scan() {
+			line := strings.TrimSpace(r.Text())
+			if len(line) > 0 && line[0] != '#' {
+				words = append(words, line)
+			}
+		}
+		if e = r.Err(); e != nil {
+			return nil, e
+		}
+	} else {
+		words = strings.FieldsFunc(source, func(c rune) bool {
+			return c == ',' || c == ' ' || c == '\t'
+		})
+	}
+	var set = make(map[string]bool)
+	for _, w := range words {
+		w = strings.ToLower(strings.Trim(w, ". "))
+		if len(w) > 0 {
+			set[w] = true
+		}
+	}
+	p := &pacFile{domains: make([]string, 0, len(set))}
+	for d, _ := range set {
+		p.domains = append(p.domains, d)
+	}
+	sort.Strings(p.domains)
+	return p, nil
+}
+
+func isPACPath(path string) bool {
+	return path == PAC_PATH || path == WPAD_PATH
+}
+
+// proxyAddr is the local address which the browser used to reach us.
+func (p *pacFile) script(proxyAddr string) []byte {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "var proxy = \"PROXY %[1]s; SOCKS5 %[1]s; DIRECT\";\n", proxyAddr)
+	buf.WriteString("var domains = {\n")
+	for i, d := range p.domains {
+		if i > 0 {
+			buf.WriteString(",\n")
+		}
+		fmt.Fprintf(buf, "\t%q: 1", d)
+	}
+	buf.WriteString("\n};\n\n")
+	buf.WriteString("function FindProxyForURL(url, host) {\n")
+	buf.WriteString("\tif (isPlainHostName(host)) return \"DIRECT\";\n")
+	if len(p.domains) == 0 { // proxy all if without domain list
+		buf.WriteString("\treturn proxy;\n}\n")
+		return buf.Bytes()
+	}
+	buf.WriteString("\tvar suffix = host.toLowerCase();\n")
+	buf.WriteString("\tfor (;;) {\n")
+	buf.WriteString("\t\tif (domains.hasOwnProperty(suffix)) return proxy;\n")
+	buf.WriteString("\t\tvar pos = suffix.indexOf(\".\");\n")
+	buf.WriteString("\t\tif (pos < 0) break;\n")
+	buf.WriteString("\t\tsuffix = suffix.substring(pos + 1);\n")
+	buf.WriteString("\t}\n")
+	buf.WriteString("\treturn \"DIRECT\";\n}\n")
+	return buf.Bytes()
+}
+
+// respond the plain GET or HEAD request for local path
+func (p *pacFile) serve(conn net.Conn, path string, head bool) {
+	if p != nil && isPACPath(path) {
+		respondHttp(conn, "200 OK", PAC_CONTENT_TYPE, p.script(conn.LocalAddr().String()), head)
+	} else {
+		respondHttp(conn, "404 Not Found", NULL, nil, head)
+	}
+}
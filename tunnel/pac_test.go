@@ -0,0 +1,72 @@
+package tunnel
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+func Test_pacDomains(t *testing.T) {
+	p, e := newPACFile("Google.com, .twitter.com  google.com\tgithub.com")
+	if e != nil {
+		t.Fatal(e)
+	}
+	assertLength(t, "pac.domains", p.domains, 3)
+	script := string(p.script("127.0.0.1:9009"))
+	for _, d := range []string{`"google.com"`, `"twitter.com"`, `"github.com"`, "PROXY 127.0.0.1:9009"} {
+		if !strings.Contains(script, d) {
+			t.Errorf("%s not found in script\n%s", d, script)
+		}
+	}
+}
+
+func Test_pacRequest(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	go remote.Write([]byte("GET /proxy.pac HTTP/1.1\r\nHost: 127.0.0.1:9009\r\n\r\n"))
+	prot, path := httpProxyHandshake(NewPushbackInputStream(local))
+	if prot != REQ_PROT_LOCAL || !isPACPath(path) {
+		t.Errorf("prot=%d path=%s", prot, path)
+	}
+
+	go remote.Write([]byte("GET http://example.com/proxy.pac HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	pbConn := NewPushbackInputStream(local)
+	prot, target := httpProxyHandshake(pbConn)
+	if prot != REQ_PROT_HTTP || target != "example.com:80" {
+		t.Errorf("prot=%d target=%s", prot, target)
+	}
+	if !bytes.HasPrefix(pbConn.buffer, []byte("GET /proxy.pac")) {
+		t.Errorf("unread buffer %q", pbConn.buffer)
+	}
+}
+
+type nilSelector struct{}
+
+func (nilSelector) SelectClient(target string, src net.Addr) *Client {
+	return nil
+}
+
+func Test_localMethods(t *testing.T) {
+	var request = func(req string) string {
+		local, remote := net.Pipe()
+		defer remote.Close()
+		l, _ := parseListener(":9009")
+		go NewFrontend(&D5ClientConf{}, l, nilSelector{}).Serve(local)
+		remote.Write([]byte(req))
+		resp, _ := ioutil.ReadAll(remote)
+		return string(resp)
+	}
+	if resp := request("POST /proxy.pac HTTP/1.1\r\nHost: 127.0.0.1:9009\r\n\r\n"); !strings.HasPrefix(resp, "HTTP/1.1 405") {
+		t.Errorf("POST responded %q", resp)
+	}
+	if resp := request("HEAD /wpad.dat HTTP/1.1\r\nHost: 127.0.0.1:9009\r\n\r\n"); !strings.HasSuffix(resp, CRLF+CRLF) {
+		t.Errorf("HEAD responded %q", resp)
+	}
+	// no client available
+	if resp := request("GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n"); !strings.HasPrefix(resp, "HTTP/1.1 503") {
+		t.Errorf("proxy request responded %q", resp)
+	}
+}
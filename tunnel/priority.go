@@ -0,0 +1,160 @@
+package tunnel
+
+import (
+	"github.com/spance/deblocus/exception"
+	"net"
+	"strings"
+	"sync"
+)
+
+const (
+	// priority classes of streams, the control frames are written as high
+	PRIO_HIGH = iota
+	PRIO_NORMAL
+	PRIO_BULK
+	PRIO_CLASSES
+	MATCH_PORT = "port:"
+	// share of the tun bandwidth is in proportion to the weight
+	PRIO_WEIGHT_MAX = 16
+)
+
+var (
+	INVALID_PRIORITY = exception.NewW("Invalid priority rule")
+	prioWeights      = [PRIO_CLASSES]int{PRIO_WEIGHT_MAX, 4, 1}
+	prioNames        = map[string]int{
+		"high":   PRIO_HIGH,
+		"normal": PRIO_NORMAL,
+		"bulk":   PRIO_BULK,
+	}
+)
+
+type priorityRule struct {
+	port   string
+	domain string
+	cidr   *net.IPNet
+	class  int
+}
+
+func (r *priorityRule) match(host, port string) bool {
+	switch {
+	case r.port != NULL:
+		return r.port == port
+	case r.cidr != nil || r.domain != NULL:
+		return matchDest(r.domain, r.cidr, host)
+	}
+	return true
+}
+
+// ordered rules, the first matched will be chosen, otherwise normal.
+// [port:N|dest:DOMAIN|dest:CIDR|*=](high|normal|bulk);...
+type priorityPolicy []*priorityRule
+
+func parsePriorityPolicy(literal string) (priorityPolicy, error) {
+	var policy priorityPolicy
+	for _, item := range strings.Split(literal, ";") {
+		item = strings.TrimSpace(item)
+		if item == NULL {
+			continue
+		}
+		var matcher, class = MATCH_ANY, item
+		if eq := strings.Index(item, "="); eq > 0 {
+			matcher, class = strings.TrimSpace(item[:eq]), strings.TrimSpace(item[eq+1:])
+		}
+		c, y := prioNames[strings.ToLower(class)]
+		if !y {
+			return nil, INVALID_PRIORITY.Apply(item)
+		}
+		var (
+			rule = &priorityRule{class: c}
+			e    error
+		)
+		switch {
+		case matcher == MATCH_ANY:
+		case strings.HasPrefix(matcher, MATCH_PORT):
+			rule.port = matcher[len(MATCH_PORT):]
+		case strings.HasPrefix(matcher, MATCH_DEST):
+			if rule.domain, rule.cidr, e = parseDestMatcher(matcher[len(MATCH_DEST):]); e != nil {
+				return nil, INVALID_PRIORITY.Apply(e)
+			}
+		default:
+			return nil, INVALID_PRIORITY.Apply(item)
+		}
+		if rule.port == NULL && rule.cidr == nil && rule.domain == NULL && matcher != MATCH_ANY {
+			return nil, INVALID_PRIORITY.Apply(item)
+		}
+		policy = append(policy, rule)
+	}
+	return policy, nil
+}
+
+func (p priorityPolicy) classify(target string) int {
+	host, port, e := net.SplitHostPort(target)
+	if e != nil {
+		host = target
+	}
+	for _, r := range p {
+		if r.match(host, port) {
+			return r.class
+		}
+	}
+	return PRIO_NORMAL
+}
+
+// weighted fair queueing of the writers of tun, the waiting writer with
+// the smallest virtual finish time will take the next turn.
+type writeScheduler struct {
+	lock    sync.Locker
+	busy    bool
+	vtime   uint64               // start time of the writing in turn
+	last    [PRIO_CLASSES]uint64 // finish time of the last writer of class
+	waiting []*writeTurn
+}
+
+type writeTurn struct {
+	start, finish uint64
+	ready         chan bool
+}
+
+func newWriteScheduler() *writeScheduler {
+	return &writeScheduler{lock: new(sync.Mutex)}
+}
+
+// block until the turn of writer
+func (s *writeScheduler) acquire(class, size int) {
+	s.lock.Lock()
+	var start = s.vtime
+	if s.last[class] > start {
+		start = s.last[class]
+	}
+	var finish = start + uint64(size*(PRIO_WEIGHT_MAX/prioWeights[class]))
+	s.last[class] = finish
+	if !s.busy {
+		s.busy, s.vtime = true, start
+		s.lock.Unlock()
+		return
+	}
+	turn := &writeTurn{start, finish, make(chan bool, 1)}
+	s.waiting = append(s.waiting, turn)
+	s.lock.Unlock()
+	<-turn.ready
+}
+
+// pass the turn to the next writer
+func (s *writeScheduler) release() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.waiting) == 0 {
+		s.busy = false
+		return
+	}
+	var next = 0
+	for i, t := range s.waiting {
+		if t.finish < s.waiting[next].finish {
+			next = i
+		}
+	}
+	turn := s.waiting[next]
+	s.waiting = append(s.waiting[:next], s.waiting[next+1:]...)
+	s.vtime = turn.start
+	turn.ready <- true
+}
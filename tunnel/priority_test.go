@@ -0,0 +1,67 @@
+package tunnel
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_priorityPolicy(t *testing.T) {
+	policy, e := parsePriorityPolicy("port:22=high; dest:*.example.com=bulk; dest:10.0.0.0/8=high")
+	if e != nil {
+		t.Fatal(e)
+	}
+	var cases = map[string]int{
+		"github.com:22":        PRIO_HIGH,
+		"dl.example.com:443":   PRIO_BULK,
+		"10.1.2.3:80":          PRIO_HIGH,
+		"www.google.com:443":   PRIO_NORMAL,
+		"badexample.com:8080":  PRIO_NORMAL,
+		"example.com:22":       PRIO_HIGH,
+		"[2001:db8::1]:443":    PRIO_NORMAL,
+		"download.example.com": PRIO_BULK,
+	}
+	for target, class := range cases {
+		if c := policy.classify(target); c != class {
+			t.Errorf("%s expected class=%d but %d", target, class, c)
+		}
+	}
+	for _, bad := range []string{"port:22=urgent", "host:a.com=bulk", "dest:1.2.3.0/33=high"} {
+		if _, e := parsePriorityPolicy(bad); e == nil {
+			t.Errorf("%q was accepted", bad)
+		}
+	}
+}
+
+func Test_writeScheduler(t *testing.T) {
+	var (
+		s     = newWriteScheduler()
+		order = make(chan int, 8)
+	)
+	s.acquire(PRIO_BULK, FRAME_MAX_LEN)
+	// queue in order: 3 bulk, 1 normal, 1 high
+	classes := []int{PRIO_BULK, PRIO_BULK, PRIO_BULK, PRIO_NORMAL, PRIO_HIGH}
+	for i, class := range classes {
+		go func(class int) {
+			s.acquire(class, FRAME_MAX_LEN)
+			order <- class
+			s.release()
+		}(class)
+		for {
+			s.lock.Lock()
+			n := len(s.waiting)
+			s.lock.Unlock()
+			if n > i {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	s.release()
+	for i, expected := range []int{PRIO_HIGH, PRIO_NORMAL, PRIO_BULK, PRIO_BULK, PRIO_BULK} {
+		if class := <-order; class != expected {
+			t.Fatalf("turn %d expected class=%d but %d", i, expected, class)
+		}
+	}
+	s.acquire(PRIO_BULK, FRAME_MAX_LEN) // idle again
+	s.release()
+}
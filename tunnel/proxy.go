@@ -0,0 +1,204 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"github.com/spance/deblocus/exception"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	PROXY_SOCKS5 = "socks5"
+	PROXY_HTTP   = "http"
+)
+
+var (
+	INVALID_PROXY        = exception.NewW("Invalid upstream proxy")
+	PROXY_AUTH_FAILED    = exception.NewW("Upstream proxy auth failed")
+	PROXY_REFUSED        = exception.NewW("Upstream proxy refused")
+	PROXY_UNEXPECTED_ACK = exception.NewW("Unexpected response of upstream proxy")
+)
+
+// upstream proxy for establishing outbound connections
+// uri: socks5://[user:pass@]host:port or http://[user:pass@]host:port
+type upstreamProxy struct {
+	scheme string
+	addr   string
+	user   string
+	pass   string
+}
+
+func parseUpstreamProxy(uri string) (*upstreamProxy, error) {
+	u, e := url.Parse(uri)
+	if e != nil {
+		return nil, INVALID_PROXY.Apply(e)
+	}
+	p := &upstreamProxy{scheme: strings.ToLower(u.Scheme), addr: u.Host}
+	if p.scheme != PROXY_SOCKS5 && p.scheme != PROXY_HTTP {
+		return nil, INVALID_PROXY.Apply("unsupported scheme " + u.Scheme)
+	}
+	if _, e = IsValidHost(p.addr); e != nil {
+		return nil, INVALID_PROXY.Apply(e)
+	}
+	if u.User != nil {
+		p.user = u.User.Username()
+		p.pass, _ = u.User.Password()
+		if p.scheme == PROXY_SOCKS5 && (len(p.user) > 0xff || len(p.pass) > 0xff) {
+			return nil, INVALID_PROXY.Apply("too long credential")
+		}
+	}
+	return p, nil
+}
+
+func (p *upstreamProxy) String() string {
+	return p.scheme + "://" + p.addr
+}
+
+// dial target through the proxy, the target could be a domain name
+// and will be resolved by the proxy.
+func (p *upstreamProxy) dial(target string, timeout time.Duration) (*net.TCPConn, error) {
+	conn, err := net.DialTimeout("tcp", p.addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	if p.scheme == PROXY_SOCKS5 {
+		err = p.socks5Handshake(conn, target)
+	} else {
+		err = p.httpHandshake(conn, target)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(ZERO_TIME)
+	return conn.(*net.TCPConn), nil
+}
+
+func (p *upstreamProxy) socks5Handshake(conn net.Conn, target string) (err error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return
+	}
+	// methods: no-auth, user/pass
+	var buf = []byte{SOCKS5_VER, 1, 0}
+	if p.user != NULL {
+		buf = []byte{SOCKS5_VER, 2, 0, 2}
+	}
+	if _, err = conn.Write(buf); err != nil {
+		return
+	}
+	ack := make([]byte, 2)
+	if _, err = io.ReadFull(conn, ack); err != nil {
+		return
+	}
+	if ack[0] != SOCKS5_VER {
+		return PROXY_UNEXPECTED_ACK.Apply(fmt.Sprintf("[% x]", ack))
+	}
+	switch ack[1] {
+	case 0:
+	case 2: // rfc1929
+		buf = []byte{1, byte(len(p.user))}
+		buf = append(buf, p.user...)
+		buf = append(buf, byte(len(p.pass)))
+		buf = append(buf, p.pass...)
+		if _, err = conn.Write(buf); err != nil {
+			return
+		}
+		if _, err = io.ReadFull(conn, ack); err != nil {
+			return
+		}
+		if ack[1] != 0 {
+			return PROXY_AUTH_FAILED.Apply(p)
+		}
+	default:
+		return PROXY_AUTH_FAILED.Apply(p)
+	}
+	// request: ver cmd rsv atyp dst.addr dst.port
+	buf = []byte{SOCKS5_VER, 1, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 0xff {
+			return INVALID_SOCKS5_REQUEST
+		}
+		buf = append(buf, DOMAIN, byte(len(host)))
+		buf = append(buf, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		buf = append(buf, IPV4)
+		buf = append(buf, ip4...)
+	} else {
+		buf = append(buf, IPV6)
+		buf = append(buf, ip...)
+	}
+	buf = append(buf, 0, 0)
+	binary.BigEndian.PutUint16(buf[len(buf)-2:], uint16(port))
+	if _, err = conn.Write(buf); err != nil {
+		return
+	}
+	// reply: ver rep rsv atyp bnd.addr bnd.port
+	buf = make([]byte, 4)
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		return
+	}
+	if buf[1] != 0 {
+		return PROXY_REFUSED.Apply(fmt.Sprintf("%s code=%d", target, buf[1]))
+	}
+	var remains int
+	switch buf[3] {
+	case IPV4:
+		remains = net.IPv4len + 2
+	case IPV6:
+		remains = net.IPv6len + 2
+	case DOMAIN:
+		if _, err = io.ReadFull(conn, buf[:1]); err != nil {
+			return
+		}
+		remains = int(buf[0]) + 2
+	default:
+		return PROXY_UNEXPECTED_ACK.Apply(fmt.Sprintf("[% x]", buf))
+	}
+	_, err = io.ReadFull(conn, make([]byte, remains))
+	return
+}
+
+func (p *upstreamProxy) httpHandshake(conn net.Conn, target string) (err error) {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "CONNECT %s HTTP/1.1%sHost: %s%s", target, CRLF, target, CRLF)
+	if p.user != NULL {
+		cred := base64.StdEncoding.EncodeToString([]byte(p.user + ":" + p.pass))
+		buf.WriteString("Proxy-Authorization: Basic " + cred + CRLF)
+	}
+	buf.WriteString(CRLF)
+	if _, err = buf.WriteTo(conn); err != nil {
+		return
+	}
+	// read byte by byte to avoid consuming the tunneled stream
+	var b = make([]byte, 1)
+	for buf.Reset(); !bytes.HasSuffix(buf.Bytes(), []byte(CRLF+CRLF)); {
+		if buf.Len() > 4096 {
+			return PROXY_UNEXPECTED_ACK.Apply("too large header")
+		}
+		if _, err = io.ReadFull(conn, b); err != nil {
+			return
+		}
+		buf.WriteByte(b[0])
+	}
+	status := strings.SplitN(buf.String(), CRLF, 2)[0]
+	if words := strings.Fields(status); len(words) < 2 || words[1] != "200" {
+		if len(words) >= 2 && words[1] == "407" {
+			return PROXY_AUTH_FAILED.Apply(p)
+		}
+		return PROXY_REFUSED.Apply(status)
+	}
+	return nil
+}
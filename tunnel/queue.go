@@ -1,19 +1,18 @@
 package tunnel
 
 import (
-	"container/list"
 	ex "github.com/spance/deblocus/exception"
 	log "github.com/spance/deblocus/golang/glog"
 	"net"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	TCP_CLOSE_R uint8 = 1
-	TCP_CLOSE_W uint8 = 1 << 1
-	TCP_CLOSED        = TCP_CLOSE_R | TCP_CLOSE_W
+	TCP_CLOSE_R uint32 = 1
+	TCP_CLOSE_W uint32 = 1 << 1
+	TCP_CLOSED         = TCP_CLOSE_R | TCP_CLOSE_W
 )
 const (
 	// close code
@@ -24,39 +23,100 @@ const (
 
 const (
 	TICKER_INTERVAL = time.Second * 15
+	// default bytes limit of each equeue
+	EQUEUE_LIMIT = 4 << 20
+	// the tun will be paused while queued bytes exceeded the multiple of limit
+	TUN_QUEUE_FACTOR = 4
 )
 
 type edgeConn struct {
-	mux      *multiplexer
-	tun      *Conn
-	conn     net.Conn
-	ready    chan byte // peer status
-	key      string
-	dest     string
-	queue    *equeue
-	positive bool // positively open
-	closed   uint8
-}
-
-func newEdgeConn(mux *multiplexer, key, dest string, tun *Conn, conn net.Conn) *edgeConn {
+	mux        *multiplexer
+	tun        atomic.Value // *Conn, moved by resuming
+	conn       net.Conn
+	ready      chan byte // peer status
+	key        string
+	dest       string
+	sid        uint32
+	queue      *equeue
+	window     *window // send credit if flow control enabled
+	stream     *stream // retransmit buffer if resumable
+	compressor *compressor
+	priority   int
+	positive   bool   // positively open
+	closed     uint32 // atomic flags of TCP_CLOSE_*
+}
+
+func newEdgeConn(mux *multiplexer, key, dest string, sid uint32, tun *Conn, conn net.Conn) *edgeConn {
 	var edge = &edgeConn{
-		mux:  mux,
-		tun:  tun,
-		conn: conn,
-		key:  key,
-		dest: dest,
+		mux:      mux,
+		conn:     conn,
+		key:      key,
+		dest:     dest,
+		sid:      sid,
+		priority: PRIO_NORMAL,
 	}
+	edge.tun.Store(tun)
 	if mux.isClient {
 		edge.ready = make(chan byte, 1)
 	}
+	if tun.features&FEATURE_FLOW_CONTROL != 0 {
+		edge.window = newWindow(STREAM_WINDOW_SIZE)
+		if tun.features&FEATURE_RESUME != 0 {
+			edge.stream = newStream(edge)
+		}
+	}
+	if tun.features&FEATURE_COMPRESS != 0 {
+		edge.compressor = new(compressor)
+	}
 	return edge
 }
 
-func (e *edgeConn) deliver(frm *frame) {
+func (e *edgeConn) getTun() *Conn {
+	return e.tun.Load().(*Conn)
+}
+
+func (e *edgeConn) setTun(tun *Conn) {
+	e.tun.Store(tun)
+}
+
+func (e *edgeConn) closedFlags() uint32 {
+	return atomic.LoadUint32(&e.closed)
+}
+
+// returns the previous flags
+func (e *edgeConn) setClosed(flags uint32) uint32 {
+	for {
+		old := atomic.LoadUint32(&e.closed)
+		if old&flags == flags || atomic.CompareAndSwapUint32(&e.closed, old, old|flags) {
+			return old
+		}
+	}
+}
+
+func (e *edgeConn) isClosed() bool {
+	return e.closedFlags() >= TCP_CLOSED
+}
+
+// force close the edge and its queue
+func (e *edgeConn) abandon() {
+	e.setClosed(TCP_CLOSED)
+	if e.queue != nil {
+		e.queue._push(&frame{action: FRAME_ACTION_CLOSE})
+	} else {
+		SafeClose(e.conn)
+		if e.window != nil {
+			e.window.close()
+		}
+	}
+}
+
+// returns false if the queue of edge was overflowed
+func (e *edgeConn) deliver(frm *frame) bool {
 	if e.queue != nil {
 		frm.conn = e
-		e.queue._push(frm)
+		return e.queue._push(frm)
 	}
+	return true
 }
 
 // ------------------------------
@@ -86,7 +146,7 @@ func (r *egressRouter) getRegistered(key string) *edgeConn {
 	r.lock.RLock()
 	var e = r.registry[key]
 	r.lock.RUnlock()
-	if e != nil && e.closed >= TCP_CLOSED {
+	if e != nil && e.isClosed() {
 		// clean when getting
 		r.lock.Lock()
 		delete(r.registry, key)
@@ -104,27 +164,62 @@ func (r *egressRouter) clean() {
 	defer r.lock.Unlock()
 	for k, e := range r.registry {
 		// call conn.LocalAddr will give rise to checking fd.
-		if e == nil || e.closed >= TCP_CLOSED || e.conn.LocalAddr() == nil {
+		if e == nil || e.isClosed() || e.conn.LocalAddr() == nil {
 			delete(r.registry, k)
 		}
 	}
 }
 
-func (r *egressRouter) register(key, destination string, tun *Conn, conn net.Conn, positive bool) *edgeConn {
+// quantity of the edges not closed
+func (r *egressRouter) live() (n int) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	for _, e := range r.registry {
+		if !e.isClosed() {
+			n++
+		}
+	}
+	return
+}
+
+// register the edge opened by peer, returns nil if the key was occupied.
+func (r *egressRouter) register(key, destination string, sid uint32, tun *Conn, conn net.Conn) *edgeConn {
 	r.lock.Lock()
 	defer r.lock.Unlock()
-	var edge = r.registry[key]
-	if edge == nil {
-		edge = newEdgeConn(r.mux, key, destination, tun, conn)
-		edge.positive = positive
-		if !positive { // in server
-			edge.initEqueue()
-		}
-		r.registry[key] = edge
+	if e := r.registry[key]; e != nil && !e.isClosed() {
+		return nil
 	}
+	edge := newEdgeConn(r.mux, key, destination, sid, tun, conn)
+	edge.initEqueue() // in server
+	r.registry[key] = edge
 	return edge
 }
 
+// allocate the next sid of tun which is not used by any live edge,
+// then register the positive edge with it.
+func (r *egressRouter) allocate(tun *Conn, destination string, conn net.Conn) *edgeConn {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var max uint32 = 0xffff
+	if tun.features&FEATURE_SID32 != 0 {
+		max = 0xffffffff
+	}
+	// the free one will be found in len(registry)+1 attempts
+	for n := len(r.registry); n >= 0; n-- {
+		if tun.sidSeq++; tun.sidSeq > max || tun.sidSeq == 0 {
+			tun.sidSeq = 1
+		}
+		key := sessionKey(tun, tun.sidSeq)
+		if e := r.registry[key]; e == nil || e.isClosed() {
+			edge := newEdgeConn(r.mux, key, destination, tun.sidSeq, tun, conn)
+			edge.positive = true
+			r.registry[key] = edge
+			return edge
+		}
+	}
+	return nil
+}
+
 // destroy whole router
 func (r *egressRouter) destroy() {
 	r.lock.Lock()
@@ -139,18 +234,40 @@ func (r *egressRouter) destroy() {
 	r.registry = nil
 }
 
-// remove edges (with queues) were related to the tun
-func (r *egressRouter) cleanOfTun(tun *Conn) {
+// remove edges (with queues) were related to the tun,
+// except the resumable streams will be detached and returned.
+func (r *egressRouter) cleanOfTun(tun *Conn) (detached []*stream) {
 	r.lock.Lock()
 	defer r.lock.Unlock()
-	var prefix = tun.identifier
 	var frm = &frame{action: FRAME_ACTION_CLOSE}
 	for k, e := range r.registry {
-		if strings.HasPrefix(k, prefix) && e.queue != nil {
+		if e.getTun() != tun || e.queue == nil {
+			continue
+		}
+		if e.stream != nil && !e.isClosed() {
+			e.stream.detach()
+			detached = append(detached, e.stream)
+		} else {
 			e.queue._push(frm)
 			delete(r.registry, k)
 		}
 	}
+	return
+}
+
+// the edge of the tun has most queued bytes
+func (r *egressRouter) heaviestOfTun(tun *Conn) (edge *edgeConn) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	var max int
+	for _, e := range r.registry {
+		if e.getTun() == tun && e.queue != nil {
+			if n := e.queue.queuedBytes(); n > max {
+				edge, max = e, n
+			}
+		}
+	}
+	return
 }
 
 func (r *egressRouter) cleanTask() {
@@ -180,10 +297,13 @@ func (r *egressRouter) stopCleanTask() {
 // Equeue
 // -------------------------------
 type equeue struct {
-	edge   *edgeConn
-	lock   sync.Locker
-	cond   *sync.Cond
-	buffer *list.List
+	edge     *edgeConn
+	lock     sync.Locker
+	cond     *sync.Cond
+	buffer   *frameRing
+	bytes    int // queued data bytes
+	limit    int
+	consumed int // delivered but not granted to peer
 }
 
 func (edge *edgeConn) initEqueue() *equeue {
@@ -192,34 +312,72 @@ func (edge *edgeConn) initEqueue() *equeue {
 		edge:   edge,
 		lock:   l,
 		cond:   sync.NewCond(l),
-		buffer: list.New(),
+		buffer: newFrameRing(RING_INITIAL_SIZE),
+		limit:  edge.mux.conf().queueLimit,
 	}
 	edge.queue = q
 	go q.sendLoop()
 	return q
 }
 
-func (q *equeue) _push(frm *frame) {
+// returns false if the data frame was rejected for exceeding the limit.
+func (q *equeue) _push(frm *frame) bool {
+	q.lock.Lock()
+	defer q.cond.Signal()
+	defer q.lock.Unlock()
+	if q.buffer == nil { // the queue was exited
+		return true
+	}
+	if frm.action == FRAME_ACTION_DATA {
+		if q.limit > 0 && q.bytes+int(frm.length) > q.limit {
+			return false
+		}
+		q.bytes += int(frm.length)
+		q.edge.getTun().enqueued(int(frm.length))
+	}
+	q.buffer.push(frm)
+	return true
+}
+
+func (q *equeue) queuedBytes() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.bytes
+}
+
+// drop the queued frames then close
+func (q *equeue) _shed() {
 	q.lock.Lock()
 	defer q.cond.Signal()
 	defer q.lock.Unlock()
-	// push
 	if q.buffer != nil {
-		q.buffer.PushBack(frm)
-	} // else the queue was exited
+		q._drop()
+		q.buffer.push(&frame{action: FRAME_ACTION_CLOSE})
+	}
+}
+
+func (q *equeue) _drop() {
+	if q.bytes > 0 {
+		q.edge.getTun().dequeued(q.bytes)
+		q.bytes = 0
+	}
+	q.buffer.reset()
 }
 
 func (q *equeue) sendLoop() {
+	var frm frame // reused for avoiding allocation
 	for {
 		q.lock.Lock()
-		for q.buffer.Len() <= 0 {
+		for q.buffer.size <= 0 {
 			q.cond.Wait()
 		}
-		item := q.buffer.Front()
-		q.buffer.Remove(item)
+		q.buffer.pop(&frm)
+		if frm.action == FRAME_ACTION_DATA {
+			q.bytes -= int(frm.length)
+			q.edge.getTun().dequeued(int(frm.length))
+		}
 		q.lock.Unlock()
 		// send
-		var frm *frame = item.Value.(*frame)
 		switch frm.action {
 		case FRAME_ACTION_CLOSE:
 			q._close(true, CLOSED_FORCE)
@@ -228,20 +386,21 @@ func (q *equeue) sendLoop() {
 			q._close(false, CLOSED_WRITE)
 			return
 		default:
-			werr := sendFrame(frm)
+			werr := sendFrame(&frm)
+			if !werr && q.edge.window != nil {
+				q.grantPeer(&frm)
+			}
 			if werr {
 				edge := q.edge
-				if edge.closed&TCP_CLOSE_W == 0 { // only positively closed can notify peer
-					edge.closed |= TCP_CLOSE_W
-					tun := edge.tun
+				// only positively closed can notify peer
+				if edge.setClosed(TCP_CLOSE_W)&TCP_CLOSE_W == 0 {
+					tun := edge.getTun()
 					// may be a broken tun
 					if (tun == nil || tun.LocalAddr() == nil) && edge.mux.isClient {
 						tun = edge.mux.pool.Select()
 					}
 					if tun != nil {
-						frm.length = 0
-						frm.action = FRAME_ACTION_CLOSE_R
-						tunWrite2(tun, frm)
+						tunWrite2(tun, &frame{action: FRAME_ACTION_CLOSE_R, sid: frm.sid})
 					}
 				}
 				q._close(true, CLOSED_BY_ERR)
@@ -251,6 +410,19 @@ func (q *equeue) sendLoop() {
 	}
 }
 
+// the peer can continue sending after being granted
+func (q *equeue) grantPeer(frm *frame) {
+	q.consumed += int(frm.length)
+	if q.consumed >= STREAM_WINDOW_UPDATE {
+		if grantPeer(q.edge.getTun(), frm.sid, q.consumed) == nil {
+			if q.edge.stream != nil {
+				q.edge.stream.delivering(q.consumed)
+			}
+			q.consumed = 0
+		}
+	}
+}
+
 // close for ending of queued task
 func (q *equeue) _close(force bool, close_code uint) {
 	q.lock.Lock()
@@ -266,11 +438,14 @@ func (q *equeue) _close(force bool, close_code uint) {
 			log.Infof("closeW %s by peer\n", e.dest)
 		}
 	}
-	q.buffer.Init()
+	q._drop()
 	q.buffer = nil
 	if force {
-		e.closed = TCP_CLOSE_R | TCP_CLOSE_W
+		e.setClosed(TCP_CLOSED)
 		SafeClose(e.conn)
+		if e.window != nil {
+			e.window.close()
+		}
 	} else {
 		closeW(e.conn)
 	}
@@ -279,7 +454,7 @@ func (q *equeue) _close(force bool, close_code uint) {
 func sendFrame(frm *frame) (werr bool) {
 	dst := frm.conn.conn
 	if log.V(5) {
-		log.Infoln("SEND queue", frm)
+		log.Infoln("SEND queue", frm.String())
 	}
 	dst.SetWriteDeadline(time.Now().Add(GENERAL_SO_TIMEOUT))
 	nw, ew := dst.Write(frm.data)
@@ -288,6 +463,52 @@ func sendFrame(frm *frame) (werr bool) {
 	}
 	werr = true
 	// an error occured
-	log.Warningf("Write edge(%s) error(%v). %s\n", frm.conn.dest, ew, frm)
+	log.Warningf("Write edge(%s) error(%v). %s\n", frm.conn.dest, ew, frm.String())
 	return
 }
+
+// -------------------------------
+// frameRing
+// -------------------------------
+const RING_INITIAL_SIZE = 16
+
+// growable ring buffer holding frames by value, the size is always power of 2.
+type frameRing struct {
+	items []frame
+	head  int
+	size  int
+}
+
+func newFrameRing(size int) *frameRing {
+	return &frameRing{items: make([]frame, size)}
+}
+
+func (r *frameRing) push(frm *frame) {
+	if r.size == len(r.items) {
+		r.grow()
+	}
+	r.items[(r.head+r.size)&(len(r.items)-1)] = *frm
+	r.size++
+}
+
+// pop the head into frm, the ring must be not empty.
+func (r *frameRing) pop(frm *frame) {
+	*frm = r.items[r.head]
+	r.items[r.head] = frame{} // release data
+	r.head = (r.head + 1) & (len(r.items) - 1)
+	r.size--
+}
+
+func (r *frameRing) grow() {
+	items := make([]frame, len(r.items)<<1)
+	n := copy(items, r.items[r.head:])
+	copy(items[n:], r.items[:r.head])
+	r.items, r.head = items, 0
+}
+
+func (r *frameRing) reset() {
+	for i := range r.items {
+		r.items[i] = frame{}
+	}
+	r.head, r.size = 0, 0
+}
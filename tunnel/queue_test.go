@@ -0,0 +1,184 @@
+package tunnel
+
+import (
+	"container/list"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+func Test_frameRing(t *testing.T) {
+	var (
+		r   = newFrameRing(4)
+		frm frame
+		seq uint32
+	)
+	// push and pop crossing the boundary and growing
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 3+round*2; i++ {
+			r.push(&frame{sid: seq + uint32(i)})
+		}
+		for i := 0; i < 3+round*2; i++ {
+			r.pop(&frm)
+			if frm.sid != seq {
+				t.Fatalf("round=%d expected sid=%d but %d", round, seq, frm.sid)
+			}
+			seq++
+		}
+	}
+	if r.size != 0 || len(r.items) != 16 {
+		t.Errorf("size=%d cap=%d", r.size, len(r.items))
+	}
+}
+
+func Test_equeueLimit(t *testing.T) {
+	var (
+		w, r = net.Pipe()
+		mux  = &multiplexer{mode: "T"}
+		tun  = &Conn{drained: make(chan bool, 1)}
+		data = make([]byte, 1000)
+	)
+	mux.configure(&muxSettings{queueLimit: 4096})
+	var (
+		edge = newEdgeConn(mux, "k", "dest", 1, tun, w)
+		q    = edge.initEqueue()
+	)
+	defer r.Close()
+	var i int
+	for ; i < 10; i++ {
+		if !edge.deliver(&frame{action: FRAME_ACTION_DATA, sid: 1, length: 1000, data: data}) {
+			break
+		}
+	}
+	if i > 5 {
+		t.Fatalf("queue limit was not applied, pushed=%d", i)
+	}
+	q.lock.Lock()
+	if n := atomic.LoadInt64(&tun.queued); q.bytes > mux.conf().queueLimit || n != int64(q.bytes) {
+		t.Fatalf("queued=%d tun.queued=%d", q.bytes, n)
+	}
+	q.lock.Unlock()
+	q._shed()
+	if n := atomic.LoadInt64(&tun.queued); n != 0 {
+		t.Fatalf("tun.queued=%d after shedding", n)
+	}
+	io.Copy(ioutil.Discard, r) // until the edge was closed
+}
+
+func Test_sidAllocate(t *testing.T) {
+	var (
+		mux = &multiplexer{mode: "T"}
+		r   = newEgressRouter(mux)
+		tun = &Conn{identifier: "t", sidSeq: 0xfffe}
+	)
+	defer r.stopCleanTask()
+	mux.router = r
+	live := r.allocate(tun, "live", nil) // 0xffff
+	r.registry[sessionKey(tun, 2)] = live
+	tun.sidSeq = 0xfffd
+	// skip the live streams and 0 after wraparound
+	for _, expected := range []uint32{0xfffe, 1, 3} {
+		edge := r.allocate(tun, "dest", nil)
+		if edge == nil || edge.sid != expected {
+			t.Fatalf("expected sid=%d but %v", expected, edge)
+		}
+	}
+	if r.register(sessionKey(tun, 3), "dest", 3, tun, nil) != nil {
+		t.Fatalf("registered to an occupied key")
+	}
+	// 32-bit
+	tun.features = FEATURE_SID32
+	tun.sidSeq = 0xffff
+	if edge := r.allocate(tun, "dest", nil); edge.sid != 0x10000 {
+		t.Fatalf("sid32 was not allocated %d", edge.sid)
+	}
+	var (
+		buf = make([]byte, FRAME_HEADER_LEN32+3)
+		frm = new(frame)
+	)
+	_frame(buf, FRAME_HEADER_LEN32, FRAME_ACTION_DATA, 0x12345678, []byte("abc"))
+	_parseFrameHeader(buf[:FRAME_HEADER_LEN32], frm)
+	if frm.sid != 0x12345678 || frm.length != 3 || frm.action != FRAME_ACTION_DATA {
+		t.Fatalf("parse header %s", frm)
+	}
+}
+
+func BenchmarkQueueList(b *testing.B) {
+	b.ReportAllocs()
+	var (
+		buf  = list.New()
+		data = make([]byte, 16)
+	)
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < 8; j++ {
+			buf.PushBack(&frame{action: FRAME_ACTION_DATA, length: 16, data: data})
+		}
+		for j := 0; j < 8; j++ {
+			item := buf.Front()
+			buf.Remove(item)
+			_ = item.Value.(*frame)
+		}
+	}
+}
+
+func BenchmarkQueueRing(b *testing.B) {
+	b.ReportAllocs()
+	var (
+		buf  = newFrameRing(RING_INITIAL_SIZE)
+		data = make([]byte, 16)
+		frm  = new(frame)
+		out  frame
+	)
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < 8; j++ {
+			frm.action, frm.length, frm.data = FRAME_ACTION_DATA, 16, data
+			buf.push(frm)
+		}
+		for j := 0; j < 8; j++ {
+			buf.pop(&out)
+		}
+	}
+}
+
+func Test_backlog(t *testing.T) {
+	ln := listenLocal(t, func(conn net.Conn) {
+		io.Copy(ioutil.Discard, conn)
+	})
+	defer ln.Close()
+	conn, e := net.Dial("tcp", ln.Addr().String())
+	if e != nil {
+		t.Fatal(e)
+	}
+	var (
+		tun  = NewConn(conn.(*net.TCPConn), nil)
+		mux  = &multiplexer{mode: "T"}
+		w, r = net.Pipe()
+		held = newBacklog(tun)
+		data = []byte("ab")
+	)
+	defer tun.Close()
+	defer r.Close()
+	mux.configure(&muxSettings{queueLimit: 4096})
+	mux.router = newEgressRouter(mux)
+	defer mux.router.stopCleanTask()
+	mux.router.register(sessionKey(tun, 1), "dest", 1, tun, w)
+	// the held frames are copied from the reused buffer
+	held.hold(&frame{action: FRAME_ACTION_DATA, sid: 1, length: 2, data: data})
+	copy(data, "cd")
+	held.hold(&frame{action: FRAME_ACTION_DATA, sid: 1, length: 2, data: data})
+	held.pause()
+	tun.drained <- true
+	// the reading of control frames is interrupted for resuming data
+	if n, e := held.readFull(make([]byte, 1), true); n != 0 || e != nil {
+		t.Fatalf("not interrupted %d %v", n, e)
+	}
+	if e = mux.resumeData(tun, held); e != nil || held.paused() {
+		t.Fatalf("resume %v paused=%v", e, held.paused())
+	}
+	var buf = make([]byte, 4)
+	if _, e = io.ReadFull(r, buf); e != nil || string(buf) != "abcd" {
+		t.Fatalf("delivered %q %v", buf, e)
+	}
+}
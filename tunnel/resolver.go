@@ -0,0 +1,440 @@
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"github.com/spance/deblocus/exception"
+	log "github.com/spance/deblocus/golang/glog"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DNS_MIN_TTL        = 5 * time.Second
+	DNS_MAX_TTL        = time.Hour
+	DNS_DEFAULT_TTL    = time.Minute      // for the results of system resolver
+	DNS_NEGATIVE_TTL   = 30 * time.Second // the upper bound of soa minimum
+	DNS_QUERY_TIMEOUT  = 3 * time.Second
+	DNS_CACHE_SIZE     = 4096
+	DNS_TYPE_A         = 1
+	DNS_TYPE_SOA       = 6
+	DNS_TYPE_AAAA      = 28
+	DNS_RCODE_NXDOMAIN = 3
+	RESOLV_CONF        = "/etc/resolv.conf"
+	RESOLV_MAX_NDOTS   = 15
+	HOSTS_FILE         = "/etc/hosts"
+)
+
+var (
+	DNS_NO_SUCH_HOST = exception.NewW("No such host")
+	DNS_BAD_RESPONSE = exception.NewW("Bad dns response")
+)
+
+type dnsEntry struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+// the nameservers and the search rules of resolv.conf
+type resolvConf struct {
+	servers []string
+	search  []string
+	ndots   int
+}
+
+// caching resolver respects the ttl of records, and caches failures as long
+// as the soa of zone said. The names in hosts file are always preferred.
+type dnsCache struct {
+	lock      *sync.RWMutex
+	entries   map[string]*dnsEntry
+	conf      *resolvConf
+	confPath  string
+	confTime  time.Time
+	hosts     map[string][]net.IP
+	hostsTime time.Time
+}
+
+var defaultResolver = newDNSCache()
+
+func newDNSCache() *dnsCache {
+	return &dnsCache{
+		lock:     new(sync.RWMutex),
+		entries:  make(map[string]*dnsEntry),
+		conf:     &resolvConf{ndots: 1},
+		confPath: RESOLV_CONF,
+	}
+}
+
+func (c *dnsCache) lookup(host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	// the absolute name is not the same as the relative one
+	host = strings.ToLower(host)
+	now := time.Now()
+	c.lock.RLock()
+	e := c.entries[host]
+	c.lock.RUnlock()
+	if e != nil && now.Before(e.expires) {
+		return e.ips, e.err
+	}
+	if ips := c.lookupHosts(strings.TrimSuffix(host, ".")); ips != nil {
+		return ips, nil
+	}
+	ips, ttl, err := c.query(host)
+	if err != nil {
+		if ttl < DNS_MIN_TTL {
+			ttl = DNS_MIN_TTL
+		} else if ttl > DNS_NEGATIVE_TTL {
+			ttl = DNS_NEGATIVE_TTL
+		}
+	} else if ttl < DNS_MIN_TTL {
+		ttl = DNS_MIN_TTL
+	} else if ttl > DNS_MAX_TTL {
+		ttl = DNS_MAX_TTL
+	}
+	if log.V(3) {
+		log.Infof("Resolved %s %v ttl=%s err=%v\n", host, ips, ttl, err)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.entries) >= DNS_CACHE_SIZE {
+		for k, v := range c.entries {
+			if now.After(v.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	if len(c.entries) < DNS_CACHE_SIZE {
+		c.entries[host] = &dnsEntry{ips, err, now.Add(ttl)}
+	}
+	return ips, err
+}
+
+// drop the cached entry, the next lookup will query again.
+func (c *dnsCache) forget(host string) {
+	host = strings.ToLower(host)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.entries, host)
+}
+
+// reload hosts file if modified
+func (c *dnsCache) lookupHosts(host string) []net.IP {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if fi, e := os.Stat(HOSTS_FILE); e == nil && fi.ModTime() != c.hostsTime {
+		c.hostsTime = fi.ModTime()
+		c.hosts = readHosts(HOSTS_FILE)
+	}
+	return c.hosts[host]
+}
+
+// reload resolv.conf if modified
+func (c *dnsCache) resolvConf() *resolvConf {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.confPath == NULL {
+		return c.conf
+	}
+	if fi, e := os.Stat(c.confPath); e == nil && fi.ModTime() != c.confTime {
+		c.confTime = fi.ModTime()
+		c.conf = readResolvConf(c.confPath)
+	}
+	return c.conf
+}
+
+// the fully qualified names to be tried in order like the libc does,
+// the name having ndots at least will be tried as is firstly.
+func (r *resolvConf) candidates(host string) []string {
+	if strings.HasSuffix(host, ".") {
+		return []string{host[:len(host)-1]}
+	}
+	var names []string
+	for _, domain := range r.search {
+		names = append(names, host+"."+domain)
+	}
+	if strings.Count(host, ".") >= r.ndots {
+		return append([]string{host}, names...)
+	}
+	return append(names, host)
+}
+
+// query the candidates in order until one was found, the later will be tried
+// only if the former does not exist.
+func (c *dnsCache) query(host string) (ips []net.IP, ttl time.Duration, err error) {
+	conf := c.resolvConf()
+	if len(conf.servers) == 0 {
+		if ips, err = net.LookupIP(host); err == nil {
+			ttl = DNS_DEFAULT_TTL
+		}
+		return
+	}
+	var negTTL = DNS_NEGATIVE_TTL
+	for _, name := range conf.candidates(host) {
+		if ips, ttl, err = queryName(conf.servers, name); err != DNS_NO_SUCH_HOST {
+			return
+		}
+		if ttl < negTTL {
+			negTTL = ttl
+		}
+	}
+	return nil, negTTL, DNS_NO_SUCH_HOST.Apply(host)
+}
+
+// query A and AAAA parallelly, the ipv6 addresses will be ahead.
+// will fallback to the system resolver if no available nameserver.
+func queryName(servers []string, host string) ([]net.IP, time.Duration, error) {
+	type result struct {
+		ips []net.IP
+		ttl time.Duration
+		err error
+	}
+	var ch = make(chan *result, 2)
+	for _, qtype := range []uint16{DNS_TYPE_AAAA, DNS_TYPE_A} {
+		go func(qtype uint16) {
+			r := new(result)
+			r.ips, r.ttl, r.err = exchange(servers, host, qtype)
+			ch <- r
+		}(qtype)
+	}
+	var (
+		r1, r2 = <-ch, <-ch
+		ttl    = r1.ttl
+	)
+	if len(r1.ips) == 0 || len(r2.ips) > 0 && r2.ttl < ttl {
+		ttl = r2.ttl
+	}
+	if len(r2.ips) > 0 && net.IP(r2.ips[0]).To4() == nil {
+		r1, r2 = r2, r1
+	}
+	ips := append(r1.ips, r2.ips...)
+	if len(ips) > 0 {
+		return ips, ttl, nil
+	}
+	// nxdomain or no records, the negative ttl is the shorter one
+	if r1.err == DNS_NO_SUCH_HOST || r2.err == DNS_NO_SUCH_HOST || r1.err == nil && r2.err == nil {
+		if r1.ttl < ttl {
+			ttl = r1.ttl
+		}
+		return nil, ttl, DNS_NO_SUCH_HOST
+	}
+	if log.V(3) {
+		log.Warningln("Fallback to system resolver", r1.err, r2.err)
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ips, DNS_DEFAULT_TTL, nil
+}
+
+// one query with the nameservers in order
+func exchange(servers []string, host string, qtype uint16) (ips []net.IP, ttl time.Duration, err error) {
+	msg := make([]byte, 12, 512)
+	// unpredictable id against the spoofed replies
+	if _, err = io.ReadFull(rand.Reader, msg[:2]); err != nil {
+		return
+	}
+	msg[2] = 1 // recursion desired
+	msg[5] = 1 // qdcount
+	for _, label := range strings.Split(host, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, 0, DNS_NO_SUCH_HOST.Apply(host)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, byte(qtype>>8), byte(qtype), 0, 1)
+	buf := make([]byte, 1500)
+	for _, server := range servers {
+		var conn net.Conn
+		conn, err = net.DialTimeout("udp", server, DNS_QUERY_TIMEOUT)
+		if err != nil {
+			continue
+		}
+		conn.SetDeadline(time.Now().Add(DNS_QUERY_TIMEOUT))
+		var n int
+		if _, err = conn.Write(msg); err == nil {
+			for { // drop the mismatched
+				if n, err = conn.Read(buf); err != nil || matchDNSReply(msg, buf[:n]) {
+					break
+				}
+			}
+		}
+		conn.Close()
+		if err == nil {
+			return parseDNSAnswers(buf[:n], qtype)
+		}
+	}
+	return
+}
+
+// the reply has the same id and question with the query,
+// the case of name may be randomized by the server.
+func matchDNSReply(query, reply []byte) bool {
+	if len(reply) < len(query) || !bytes.Equal(reply[:2], query[:2]) {
+		return false
+	}
+	return binary.BigEndian.Uint16(reply[4:]) == 1 && bytes.EqualFold(reply[12:len(query)], query[12:])
+}
+
+// the ttl of negative answer is the minimum of soa in authority section,
+// or zero if absent.
+func parseDNSAnswers(msg []byte, qtype uint16) (ips []net.IP, ttl time.Duration, err error) {
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&0x200 != 0 { // truncated
+		return nil, 0, DNS_BAD_RESPONSE.Apply("truncated")
+	}
+	switch flags & 0xf {
+	case 0:
+	case DNS_RCODE_NXDOMAIN:
+		err = DNS_NO_SUCH_HOST
+	default:
+		return nil, 0, DNS_BAD_RESPONSE.Apply(flags & 0xf)
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+	nscount := int(binary.BigEndian.Uint16(msg[8:]))
+	ofs := 12
+	for i := 0; i < qdcount; i++ {
+		if ofs = skipDNSName(msg, ofs) + 4; ofs > len(msg) {
+			return nil, 0, DNS_BAD_RESPONSE
+		}
+	}
+	var minTTL, negTTL uint32 = 0xffffffff, 0
+	for i := 0; i < ancount+nscount; i++ {
+		if ofs = skipDNSName(msg, ofs); ofs+10 > len(msg) {
+			return nil, 0, DNS_BAD_RESPONSE
+		}
+		rtype := binary.BigEndian.Uint16(msg[ofs:])
+		rttl := binary.BigEndian.Uint32(msg[ofs+4:])
+		rdlen := int(binary.BigEndian.Uint16(msg[ofs+8:]))
+		ofs += 10
+		if ofs+rdlen > len(msg) {
+			return nil, 0, DNS_BAD_RESPONSE
+		}
+		if i >= ancount {
+			// soa rdata ends with the minimum
+			if rtype == DNS_TYPE_SOA && rdlen >= 22 {
+				if negTTL = binary.BigEndian.Uint32(msg[ofs+rdlen-4:]); rttl < negTTL {
+					negTTL = rttl
+				}
+			}
+			ofs += rdlen
+			continue
+		}
+		// cname chain is included in ttl
+		if rttl < minTTL {
+			minTTL = rttl
+		}
+		if rtype == qtype && (rdlen == net.IPv4len || rdlen == net.IPv6len) {
+			ip := make(net.IP, rdlen)
+			copy(ip, msg[ofs:])
+			ips = append(ips, ip)
+		}
+		ofs += rdlen
+	}
+	if len(ips) > 0 {
+		ttl = time.Duration(minTTL) * time.Second
+	} else {
+		ttl = time.Duration(negTTL) * time.Second
+	}
+	return
+}
+
+// returns the offset after the name or out of bound
+func skipDNSName(msg []byte, ofs int) int {
+	for ofs < len(msg) {
+		l := int(msg[ofs])
+		switch {
+		case l == 0:
+			return ofs + 1
+		case l&0xc0 == 0xc0: // compression pointer
+			return ofs + 2
+		default:
+			ofs += l + 1
+		}
+	}
+	return len(msg) + 1
+}
+
+// the last one of domain and search wins like the libc does
+func readResolvConf(path string) *resolvConf {
+	var conf = &resolvConf{ndots: 1}
+	f, e := os.Open(path)
+	if e != nil {
+		return conf
+	}
+	defer f.Close()
+	r := bufio.NewScanner(f)
+	for r.Scan() {
+		words := strings.Fields(r.Text())
+		if len(words) < 2 {
+			continue
+		}
+		switch words[0] {
+		case "nameserver":
+			// without zone of link-local
+			if ip := net.ParseIP(words[1]); ip != nil {
+				conf.servers = append(conf.servers, net.JoinHostPort(ip.String(), "53"))
+			}
+		case "domain":
+			conf.search = []string{strings.TrimSuffix(words[1], ".")}
+		case "search":
+			conf.search = nil
+			for _, d := range words[1:] {
+				if d = strings.TrimSuffix(d, "."); d != NULL {
+					conf.search = append(conf.search, d)
+				}
+			}
+		case "options":
+			for _, opt := range words[1:] {
+				if strings.HasPrefix(opt, "ndots:") {
+					if n, e := strconv.Atoi(opt[6:]); e == nil && n >= 0 {
+						if n > RESOLV_MAX_NDOTS {
+							n = RESOLV_MAX_NDOTS
+						}
+						conf.ndots = n
+					}
+				}
+			}
+		}
+	}
+	return conf
+}
+
+func readHosts(path string) map[string][]net.IP {
+	f, e := os.Open(path)
+	if e != nil {
+		return nil
+	}
+	defer f.Close()
+	var hosts = make(map[string][]net.IP)
+	r := bufio.NewScanner(f)
+	for r.Scan() {
+		line := r.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		words := strings.Fields(line)
+		if len(words) < 2 {
+			continue
+		}
+		if ip := net.ParseIP(words[0]); ip != nil {
+			for _, h := range words[1:] {
+				h = strings.ToLower(h)
+				hosts[h] = append(hosts[h], ip)
+			}
+		}
+	}
+	return hosts
+}
@@ -0,0 +1,251 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// answers a.test with 192.0.2.7 ttl=300, others with NXDOMAIN
+func startFakeNameserver(t *testing.T, queries *int32) string {
+	conn, e := net.ListenPacket("udp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	go func() {
+		defer conn.Close()
+		buf := make([]byte, 512)
+		for {
+			n, addr, e := conn.ReadFrom(buf)
+			if e != nil {
+				return
+			}
+			atomic.AddInt32(queries, 1)
+			msg := append([]byte{}, buf[:n]...)
+			msg[2] |= 0x80 // response
+			qtype := binary.BigEndian.Uint16(msg[n-4:])
+			if string(msg[13:14]) != "a" {
+				msg[3] |= DNS_RCODE_NXDOMAIN
+			} else if qtype == DNS_TYPE_A {
+				msg[7] = 1 // ancount
+				// pointer to question name, type A, class IN, ttl, rdlen, rdata
+				msg = append(msg, 0xc0, 12, 0, 1, 0, 1, 0, 0, 1, 0x2c, 0, 4, 192, 0, 2, 7)
+			}
+			conn.WriteTo(msg, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func Test_dnsCache(t *testing.T) {
+	var queries int32
+	c := newDNSCache()
+	c.confPath = NULL
+	c.conf.servers = []string{startFakeNameserver(t, &queries)}
+	for i := 0; i < 3; i++ {
+		ips, e := c.lookup("a.test")
+		if e != nil || len(ips) != 1 || !ips[0].Equal(net.IPv4(192, 0, 2, 7)) {
+			t.Fatalf("lookup a.test %v %v", ips, e)
+		}
+	}
+	if ttl := c.entries["a.test"].expires.Sub(time.Now()); ttl < 290*time.Second || ttl > 300*time.Second {
+		t.Errorf("ttl=%s", ttl)
+	}
+	for i := 0; i < 3; i++ {
+		if _, e := c.lookup("b.test"); e == nil {
+			t.Fatalf("lookup b.test should be failed")
+		}
+	}
+	// A+AAAA for each name once
+	if n := atomic.LoadInt32(&queries); n != 4 {
+		t.Errorf("queries=%d", n)
+	}
+	// nxdomain without soa is cached shortly
+	if ttl := c.entries["b.test"].expires.Sub(time.Now()); ttl > DNS_MIN_TTL {
+		t.Errorf("negative ttl=%s", ttl)
+	}
+	// the short name is searched in the domains
+	c.conf.search = []string{"test"}
+	if ips, e := c.lookup("a"); e != nil || len(ips) != 1 {
+		t.Fatalf("lookup a %v %v", ips, e)
+	}
+}
+
+func Test_resolvConf(t *testing.T) {
+	dir, e := ioutil.TempDir("", "deblocus")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "resolv.conf")
+	ioutil.WriteFile(path, []byte("domain a.example\nsearch b.example c.example.\nnameserver 192.0.2.53\noptions ndots:2 rotate\n"), 0644)
+	c := newDNSCache()
+	c.confPath = path
+	conf := c.resolvConf()
+	if len(conf.servers) != 1 || conf.servers[0] != "192.0.2.53:53" || conf.ndots != 2 {
+		t.Fatalf("conf %+v", conf)
+	}
+	var expected = map[string]string{
+		"x":     "x.b.example x.c.example x",
+		"x.y":   "x.y.b.example x.y.c.example x.y",
+		"x.y.z": "x.y.z x.y.z.b.example x.y.z.c.example",
+		"x.y.":  "x.y",
+	}
+	for host, names := range expected {
+		if s := strings.Join(conf.candidates(host), " "); s != names {
+			t.Errorf("%s candidates %s", host, s)
+		}
+	}
+	// reloaded once modified
+	ioutil.WriteFile(path, []byte("nameserver 192.0.2.54\n"), 0644)
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+	if conf = c.resolvConf(); conf.servers[0] != "192.0.2.54:53" || len(conf.search) != 0 || conf.ndots != 1 {
+		t.Fatalf("reloaded %+v", conf)
+	}
+}
+
+func Test_parseDNSNegative(t *testing.T) {
+	msg := []byte{0, 1, 0x81, 0x83, 0, 1, 0, 0, 0, 1, 0, 0, 1, 'x', 0, 0, 1, 0, 1}
+	// soa ttl=3600 with minimum=10
+	msg = append(msg, 0xc0, 12, 0, 6, 0, 1, 0, 0, 0x0e, 0x10, 0, 22, 0, 0)
+	msg = append(msg, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3, 0, 0, 0, 4, 0, 0, 0, 10)
+	ips, ttl, e := parseDNSAnswers(msg, DNS_TYPE_A)
+	if e != DNS_NO_SUCH_HOST || len(ips) != 0 || ttl != 10*time.Second {
+		t.Fatalf("ips=%v ttl=%s err=%v", ips, ttl, e)
+	}
+}
+
+func Test_matchDNSReply(t *testing.T) {
+	query := []byte{0x12, 0x34, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0, 1, 'x', 0, 0, 1, 0, 1}
+	reply := []byte{0x12, 0x34, 0x81, 0x80, 0, 1, 0, 0, 0, 0, 0, 0, 1, 'X', 0, 0, 1, 0, 1}
+	if !matchDNSReply(query, reply) {
+		t.Fatalf("dropped the matched")
+	}
+	reply[16] = DNS_TYPE_AAAA
+	if matchDNSReply(query, reply) {
+		t.Fatalf("accepted the mismatched qtype")
+	}
+	reply[16], reply[13] = DNS_TYPE_A, 'y'
+	if matchDNSReply(query, reply) {
+		t.Fatalf("accepted the mismatched qname")
+	}
+	reply[13], reply[1] = 'x', 0x35
+	if matchDNSReply(query, reply) || matchDNSReply(query, reply[:12]) {
+		t.Fatalf("accepted the mismatched id or short reply")
+	}
+}
+
+func Test_happyDial(t *testing.T) {
+	ln, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, e := ln.Accept()
+			if e != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	// the first is unreachable or blackholed
+	ips := sortByFamily([]net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("127.0.0.1")})
+	start := time.Now()
+	conn, e := happyDial(ips, port, GENERAL_SO_TIMEOUT, nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	conn.Close()
+	if d := time.Since(start); d > HE_ATTEMPT_DELAY*2 {
+		t.Errorf("fallback too slow %s", d)
+	}
+	sorted := sortByFamily([]net.IP{net.ParseIP("::1"), net.ParseIP("::2"), net.ParseIP("10.0.0.1")})
+	if sorted[1].To4() == nil {
+		t.Errorf("not interleaved %v", sorted)
+	}
+}
+
+func Test_d5pRedial(t *testing.T) {
+	ln, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	d5p, e := NewD5Params("d5://u:p@localhost:" + port + "#AES128CFB")
+	if e != nil {
+		t.Fatal(e)
+	}
+	conn, e := d5p.dial()
+	if e != nil {
+		t.Fatal(e)
+	}
+	conn.Close()
+	var ep = d5p.endpoints[0]
+	if ep.addrs != "127.0.0.1" {
+		t.Fatalf("resolved addrs=%s", ep.addrs)
+	}
+	d5p.resolved(ep, []net.IP{net.ParseIP("::1"), net.ParseIP("127.0.0.1")})
+	if ep.addrs != "127.0.0.1,::1" {
+		t.Fatalf("changed addrs=%s", ep.addrs)
+	}
+	// unresolvable at parsing is acceptable for dynamic dns
+	if _, e = NewD5Params("d5://u:p@unresolvable.invalid:9008#AES128CFB"); e != nil {
+		t.Fatal(e)
+	}
+}
+
+func Test_d5pEndpoints(t *testing.T) {
+	d5p, e := NewD5Params("d5://u:p@a.example:9008,:443,[2001:db8::1]:9008#AES128CFB")
+	if e != nil {
+		t.Fatal(e)
+	}
+	var expected = []string{"a.example:9008", "a.example:443", "[2001:db8::1]:9008"}
+	if len(d5p.endpoints) != len(expected) {
+		t.Fatalf("endpoints=%d", len(d5p.endpoints))
+	}
+	for i, addr := range expected {
+		if d5p.endpoints[i].addr != addr {
+			t.Fatalf("endpoint %d expected %s but %s", i, addr, d5p.endpoints[i].addr)
+		}
+	}
+	d5p.provider = "p"
+	if name := d5p.RemoteName(); name != "p/u@a.example:9008" {
+		t.Fatalf("remote name %s", name)
+	}
+	// fallback to the alternate port then remember it
+	ln, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer ln.Close()
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed.Close()
+	_, good, _ := net.SplitHostPort(ln.Addr().String())
+	d5p, e = NewD5Params("d5://u:p@" + closed.Addr().String() + ",:" + good + "#AES128CFB")
+	if e != nil {
+		t.Fatal(e)
+	}
+	for i := 0; i < 2; i++ {
+		conn, e := d5p.dial()
+		if e != nil {
+			t.Fatal(e)
+		}
+		conn.Close()
+		if d5p.last != 1 {
+			t.Fatalf("last good endpoint=%d", d5p.last)
+		}
+	}
+	if _, e = NewD5Params("d5://u:p@:9008#AES128CFB"); e == nil {
+		t.Fatalf("endpoint without host was accepted")
+	}
+}
@@ -0,0 +1,287 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	log "github.com/spance/deblocus/golang/glog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// the detached stream will be abandoned if not resumed in time
+	RESUME_TIMEOUT = time.Second * 30
+	// received(8) granted(8), or empty for refusing
+	RESUME_BODY_LEN = 16
+)
+
+// resumable stream keeps the bytes were sent but not granted by peer,
+// which will be retransmitted on another tun after the previous broken.
+// the grants of flow control are the acknowledgements.
+type stream struct {
+	edge      *edgeConn
+	lock      sync.Locker // of the state, never held while writing tun
+	wlock     sync.Locker // of the writing
+	buf       []byte      // frame buffer, guarded by wlock
+	data      []byte      // not granted
+	base      uint64      // sequence of data[0]
+	sent      uint64
+	granted   uint64 // total granted by peer
+	recv      uint64 // total received from peer
+	delivered uint64 // total granted to peer
+	eof       bool
+	eofSent   bool
+	detached  bool
+	epoch     int         // increased by detaching and resuming
+	counted   bool        // in the active streams of current tun
+	timer     *time.Timer // of abandoning the detached
+}
+
+func newStream(edge *edgeConn) *stream {
+	return &stream{
+		edge:  edge,
+		lock:  new(sync.Mutex),
+		wlock: new(sync.Mutex),
+	}
+}
+
+// buffer the data then send, the sending error will be ignored
+// because the broken tun will be replaced by migration.
+func (s *stream) write(b []byte) {
+	s.lock.Lock()
+	s.data = append(s.data, b...)
+	s.lock.Unlock()
+	s.flush()
+}
+
+// send CLOSE_W after all of data
+func (s *stream) close() {
+	s.lock.Lock()
+	s.eof = true
+	s.lock.Unlock()
+	s.flush()
+}
+
+// the state is taken under lock but the tun is written without it, so the
+// reading of tun delivering the grants is never blocked by a stalled writing.
+func (s *stream) flush() error {
+	s.wlock.Lock()
+	defer s.wlock.Unlock()
+	if s.buf == nil {
+		s.buf = make([]byte, FRAME_MAX_LEN)
+	}
+	for {
+		s.lock.Lock()
+		if s.detached {
+			s.lock.Unlock()
+			return nil
+		}
+		var (
+			tun   = s.edge.getTun()
+			hlen  = tun.headerLen()
+			epoch = s.epoch
+			chunk []byte
+			eof   bool
+		)
+		switch {
+		case s.sent < s.base+uint64(len(s.data)):
+			// the bytes of data before its end are never modified by appending
+			chunk = s.data[s.sent-s.base:]
+			if len(chunk) > FRAME_MAX_LEN-hlen {
+				chunk = chunk[:FRAME_MAX_LEN-hlen]
+			}
+		case s.eof && !s.eofSent:
+			eof = true
+		default:
+			s.lock.Unlock()
+			return nil
+		}
+		s.lock.Unlock()
+		var err error
+		if eof {
+			_frame(s.buf, hlen, FRAME_ACTION_CLOSE_W, s.edge.sid, nil)
+			err = tunWrite1(tun, s.buf[:hlen])
+		} else {
+			n := s.edge.mux.dataFrame(s.buf, hlen, s.edge.sid, chunk, s.edge.compressor)
+			err = tunWriteP(tun, s.buf[:n], s.edge.priority)
+		}
+		if err != nil {
+			return err
+		}
+		s.lock.Lock()
+		if s.epoch == epoch { // not rewound by resuming
+			if eof {
+				s.eofSent = true
+			} else {
+				s.sent += uint64(len(chunk))
+			}
+		}
+		s.lock.Unlock()
+	}
+}
+
+// the granted were delivered by peer, needn't be retransmitted.
+func (s *stream) ack(n int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s._ack(s.granted + uint64(n))
+}
+
+// returns the increment of granted
+func (s *stream) _ack(granted uint64) (credit int) {
+	if granted > s.granted {
+		credit = int(granted - s.granted)
+		s.granted = granted
+	}
+	if drop := s.granted - s.base; drop > 0 && drop <= uint64(len(s.data)) {
+		s.data = s.data[drop:]
+		s.base = s.granted
+	}
+	return
+}
+
+func (s *stream) received(n int) {
+	s.lock.Lock()
+	s.recv += uint64(n)
+	s.lock.Unlock()
+}
+
+func (s *stream) delivering(n int) {
+	s.lock.Lock()
+	s.delivered += uint64(n)
+	s.lock.Unlock()
+}
+
+// stop sending on the broken tun, only the timer of the latest detaching
+// could abandon the stream.
+func (s *stream) detach() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.detached = true
+	s.epoch++
+	s.stopTimer()
+	var timer *time.Timer
+	timer = time.AfterFunc(RESUME_TIMEOUT, func() {
+		s.lock.Lock()
+		expired := s.detached && s.timer == timer
+		s.lock.Unlock()
+		if expired {
+			log.Warningf("Abandon stream(%s) was not resumed in %s\n", s.edge.dest, RESUME_TIMEOUT)
+			s.edge.abandon()
+		}
+	})
+	s.timer = timer
+}
+
+func (s *stream) stopTimer() {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+}
+
+// the active stream is counted on the tun carrying it
+func (s *stream) count(active bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.counted != active {
+		s.counted = active
+		if active {
+			atomic.AddInt32(&s.edge.getTun().streams, 1)
+		} else {
+			atomic.AddInt32(&s.edge.getTun().streams, -1)
+		}
+	}
+}
+
+// move to the tun and returns the RESUME frame with local state
+func (s *stream) attach(tun *Conn) []byte {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if old := s.edge.getTun(); s.counted && old != tun {
+		atomic.AddInt32(&old.streams, -1)
+		atomic.AddInt32(&tun.streams, 1)
+	}
+	s.edge.setTun(tun)
+	hlen := tun.headerLen()
+	buf := make([]byte, hlen+RESUME_BODY_LEN)
+	_frame(buf, hlen, FRAME_ACTION_RESUME, s.edge.sid, uint16(RESUME_BODY_LEN))
+	binary.BigEndian.PutUint64(buf[hlen:], s.recv)
+	binary.BigEndian.PutUint64(buf[hlen+8:], s.delivered)
+	return buf
+}
+
+// continue sending from the peer received
+func (s *stream) resume(body []byte) bool {
+	if len(body) != RESUME_BODY_LEN {
+		return false
+	}
+	var (
+		peerRecv    = binary.BigEndian.Uint64(body)
+		peerGranted = binary.BigEndian.Uint64(body[8:])
+	)
+	s.lock.Lock()
+	if credit := s._ack(peerGranted); credit > 0 && s.edge.window != nil {
+		s.edge.window.grant(credit) // the lost grants
+	}
+	if peerRecv < s.base || peerRecv > s.base+uint64(len(s.data)) {
+		s.lock.Unlock()
+		return false
+	}
+	s.sent = peerRecv
+	s.eofSent = false
+	s.detached = false
+	s.epoch++
+	s.stopTimer()
+	s.lock.Unlock()
+	if log.V(2) {
+		log.Infof("Resume stream(%s) sid=%d from %d\n", s.edge.dest, s.edge.sid, peerRecv)
+	}
+	go s.flush()
+	return true
+}
+
+// re-attach the streams of broken tun to another tun of pool concurrently
+func (p *multiplexer) migrate(streams []*stream) {
+	var deadline = time.Now().Add(RESUME_TIMEOUT)
+	for _, s := range streams {
+		go p.reattach(s, deadline)
+	}
+}
+
+func (p *multiplexer) reattach(s *stream, deadline time.Time) {
+	for {
+		if tun := p.pool.Select(); tun != nil {
+			if tunWrite1(tun, s.attach(tun)) == nil {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			return // will be abandoned
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func (p *multiplexer) onResume(tun *Conn, key string, frm *frame) {
+	edge := p.router.getRegistered(key)
+	if p.isClient { // the reply
+		if edge != nil && edge.stream != nil && !edge.stream.resume(frm.data) {
+			edge.abandon()
+		}
+		return
+	}
+	if edge == nil || edge.stream == nil {
+		// refuse
+		buf := make([]byte, tun.headerLen())
+		_frame(buf, len(buf), FRAME_ACTION_RESUME, frm.sid, nil)
+		tunWrite1(tun, buf)
+		return
+	}
+	reply := edge.stream.attach(tun)
+	if edge.stream.resume(frm.data) {
+		tunWrite1(tun, reply)
+	} else {
+		edge.abandon()
+	}
+}
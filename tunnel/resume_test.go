@@ -0,0 +1,157 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func listenLocal(t *testing.T, serve func(net.Conn)) net.Listener {
+	ln, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	go func() {
+		for {
+			conn, e := ln.Accept()
+			if e != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return ln
+}
+
+func Test_streamMigration(t *testing.T) {
+	echo := listenLocal(t, func(conn net.Conn) {
+		io.Copy(conn, conn)
+		conn.Close()
+	})
+	defer echo.Close()
+	svr := NewServerMultiplexer()
+	defer svr.router.stopCleanTask()
+	svrLn := listenLocal(t, func(conn net.Conn) {
+		tun := newTestConn(conn)
+		tun.identifier = "session"
+		svr.Listen(tun, nil, 0)
+	})
+	defer svrLn.Close()
+	clt := NewClientMultiplexer()
+	defer clt.router.stopCleanTask()
+	for i := 0; i < 2; i++ {
+		conn, e := net.Dial("tcp", svrLn.Addr().String())
+		if e != nil {
+			t.Fatal(e)
+		}
+		tun := newTestConn(conn)
+		tun.identifier = "client"
+		go clt.Listen(tun, nil, 0)
+	}
+	for clt.pool.Len() < 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// user connection
+	front := listenLocal(t, func(conn net.Conn) {
+		clt.HandleRequest("T", conn, echo.Addr().String())
+	})
+	defer front.Close()
+	conn, e := net.Dial("tcp", front.Addr().String())
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer conn.Close()
+
+	var (
+		sent = make([]byte, 1<<20)
+		recv = make([]byte, len(sent))
+		half = len(sent) >> 1
+	)
+	io.ReadFull(rand.Reader, sent)
+	go conn.Write(sent)
+	if _, e = io.ReadFull(conn, recv[:half]); e != nil {
+		t.Fatal(e)
+	}
+	// kill the tun carrying the stream
+	var broken *Conn
+	clt.router.lock.RLock()
+	for _, edge := range clt.router.registry {
+		broken = edge.getTun()
+	}
+	clt.router.lock.RUnlock()
+	broken.Close()
+
+	conn.SetReadDeadline(time.Now().Add(RESUME_TIMEOUT / 2))
+	if _, e = io.ReadFull(conn, recv[half:]); e != nil {
+		t.Fatal(e)
+	}
+	if !bytes.Equal(sent, recv) {
+		t.Fatalf("stream was corrupted after migration")
+	}
+	// the abandoning timer will be stopped by the reply of resuming
+	var running = func() (n int) {
+		clt.router.lock.RLock()
+		defer clt.router.lock.RUnlock()
+		for _, edge := range clt.router.registry {
+			edge.stream.lock.Lock()
+			if edge.stream.timer != nil {
+				n++
+			}
+			edge.stream.lock.Unlock()
+		}
+		return
+	}
+	for i := 0; running() > 0; i++ {
+		if i > 100 {
+			t.Fatalf("timer of resumed stream is still running")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// the active stream was moved with migrating
+	var active int32
+	for _, tun := range clt.pool.list() {
+		active += tun.activeStreams()
+	}
+	if n := broken.activeStreams(); n != 0 || active != 1 {
+		t.Fatalf("streams of broken=%d of pool=%d", n, active)
+	}
+}
+
+func Test_streamFlushUnlocked(t *testing.T) {
+	var hold = make(chan bool)
+	defer close(hold)
+	ln := listenLocal(t, func(conn net.Conn) {
+		<-hold // never read
+		conn.Close()
+	})
+	defer ln.Close()
+	conn, e := net.Dial("tcp", ln.Addr().String())
+	if e != nil {
+		t.Fatal(e)
+	}
+	var (
+		tun  = newTestConn(conn)
+		mux  = NewClientMultiplexer()
+		w, r = net.Pipe()
+		s    = newStream(newEdgeConn(mux, "k", "dest", 1, tun, w))
+		done = make(chan bool)
+	)
+	defer mux.router.stopCleanTask()
+	defer r.Close()
+	defer tun.Close()
+	go s.write(make([]byte, 16<<20)) // blocked by the peer
+	time.Sleep(100 * time.Millisecond)
+	go func() {
+		s.received(1)
+		s.ack(1)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("the state was locked by the blocked writing")
+	}
+}
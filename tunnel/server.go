@@ -18,6 +18,8 @@ const (
 	GENERATE_TOKEN_NUM = 16
 	TOKENS_FLOOR       = 2
 	PARALLEL_TUN_QTY   = 2
+	MAX_TUN_QTY        = 8
+	DRAIN_TIMEOUT      = 30 // second
 	TKSZ               = sha1.Size
 )
 
@@ -35,6 +37,8 @@ type Session struct {
 	cipherFactory *CipherFactory
 	tokens        map[string]bool
 	sigTun        *signalTunnel
+	features      uint16
+	dtCnt         int32
 }
 
 func NewSession(tun *Conn, cf *CipherFactory, identity string) *Session {
@@ -73,6 +77,7 @@ func (t *Session) onSTDisconnected() {
 	SafeClose(t.tun)
 	atomic.AddInt32(&t.svr.stCnt, -1)
 	log.Warningf("Client(%s)-ST was disconnected\n", tid)
+	t.svr.sessionMgr.remove(t)
 	i := t.svr.sessionMgr.clearTokens(t)
 	if log.V(4) {
 		log.Infof("Clear tokens %d of %s\n", i, tid)
@@ -91,6 +96,12 @@ func (t *Session) commandHandler(cmd byte, args []byte) {
 
 func (t *Session) DataTunServe(fconn *Conn, buf []byte) {
 	var svr = t.svr
+	defer atomic.AddInt32(&t.dtCnt, -1)
+	if n := atomic.AddInt32(&t.dtCnt, 1); n > int32(svr.conf().MaxTunnels) {
+		log.Warningf("Client(%s)-DT was refused, exceeded the limit %d\n", fconn.identifier, svr.conf().MaxTunnels)
+		SafeClose(fconn)
+		return
+	}
 	defer func() {
 		atomic.AddInt32(&svr.dtCnt, -1)
 		SafeClose(fconn)
@@ -103,6 +114,12 @@ func (t *Session) DataTunServe(fconn *Conn, buf []byte) {
 	atomic.AddInt32(&svr.dtCnt, 1)
 	token := buf[:TKSZ]
 	fconn.cipher = t.cipherFactory.NewCipher(token)
+	fconn.uid = t.uid
+	fconn.features = t.features
+	if t.features&FEATURE_RESUME != 0 {
+		// session scoped, the streams could be resumed on any tun of session
+		fconn.identifier = t.tun.identifier
+	}
 	log.Infof("Client(%s)-DT is established\n", fconn.identifier)
 	svr.mux.Listen(fconn, t.eventHandler, DT_PING_INTERVAL)
 }
@@ -121,16 +138,40 @@ type SessionContainer map[string]*Session
 //
 type SessionMgr struct {
 	container SessionContainer
+	sessions  map[*Session]bool // having signal tunnel
 	lock      *sync.RWMutex
 }
 
 func NewSessionMgr() *SessionMgr {
 	return &SessionMgr{
 		container: make(SessionContainer),
+		sessions:  make(map[*Session]bool),
 		lock:      new(sync.RWMutex),
 	}
 }
 
+func (s *SessionMgr) add(session *Session) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sessions[session] = true
+}
+
+func (s *SessionMgr) remove(session *Session) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.sessions, session)
+}
+
+func (s *SessionMgr) list() []*Session {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var list = make([]*Session, 0, len(s.sessions))
+	for session := range s.sessions {
+		list = append(list, session)
+	}
+	return list
+}
+
 func (s *SessionMgr) take(token []byte) *Session {
 	s.lock.Lock()
 	defer s.lock.Unlock()
@@ -196,27 +237,38 @@ func (s *SessionMgr) createTokens(session *Session, many int) []byte {
 //
 //
 type Server struct {
-	*D5ServConf
+	d5s        *D5ServConf // replaced by reloading, read by conf()
+	lock       *sync.RWMutex
 	dhKeys     *DHKeyPair
 	sessionMgr *SessionMgr
 	mux        *multiplexer
 	dtCnt      int32
 	stCnt      int32
+	draining   int32
 }
 
 func NewServer(d5s *D5ServConf, dhKeys *DHKeyPair) *Server {
+	mux := NewServerMultiplexer()
+	mux.configure(d5s.muxSettings())
 	return &Server{
-		d5s, dhKeys, NewSessionMgr(), NewServerMultiplexer(), 0, 0,
+		d5s, new(sync.RWMutex), dhKeys, NewSessionMgr(), mux, 0, 0, 0,
 	}
 }
 
+// the current config, should not be modified
+func (t *Server) conf() *D5ServConf {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.d5s
+}
+
 func (t *Server) TunnelServe(conn *net.TCPConn) {
 	fconn := NewConnWithHash(conn)
 	defer func() {
 		fconn.FreeHash()
 		ex.CatchException(recover())
 	}()
-	nego := &d5SNegotiation{Server: t}
+	nego := &d5SNegotiation{Server: t, D5ServConf: t.conf()}
 	session, err := nego.negotiate(fconn)
 	if session != nil {
 		// unique
@@ -232,17 +284,64 @@ func (t *Server) TunnelServe(conn *net.TCPConn) {
 				t.sessionMgr.clearTokens(session)
 			}
 		}
+	} else if session != nil && atomic.LoadInt32(&t.draining) > 0 {
+		// the DTs of known sessions are still accepted for resuming streams
+		log.Warningln("Refuse new client while draining", fconn.identifier)
+		SafeClose(conn)
+		t.sessionMgr.clearTokens(session)
 	} else if session != nil { // signalTunnel
 		atomic.AddInt32(&t.stCnt, 1)
 		log.Infof("Client(%s)-ST is established\n", fconn.identifier)
 		var st = NewSignalTunnel(session.tun, 0)
 		session.svr = t
 		session.sigTun = st
+		t.sessionMgr.add(session)
 		go st.start(session.eventHandler)
 	}
 }
 
+// stop accepting negotiations and tell the clients to go away,
+// then wait for the existing streams to finish before closing.
+func (t *Server) Drain() {
+	if !atomic.CompareAndSwapInt32(&t.draining, 0, 1) {
+		return
+	}
+	var (
+		sessions = t.sessionMgr.list()
+		timeout  = time.Duration(t.conf().DrainWait) * time.Second
+	)
+	for _, session := range sessions {
+		session.sigTun.postCommand(CTL_GOAWAY, nil)
+	}
+	log.Infof("Draining %d streams of %d clients in %s\n", t.mux.router.live(), len(sessions), timeout)
+	if cut := t.mux.drain(timeout); cut > 0 {
+		log.Warningf("Drain timeout, %d streams were cut\n", cut)
+	} else {
+		log.Infoln("Drained all streams")
+	}
+}
+
+// apply the reloaded config to the new sessions and streams, but the listening
+// address and the key can't be changed without restarting.
+func (t *Server) Reload(d5s *D5ServConf) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var old = t.d5s
+	if d5s.Listen != old.Listen {
+		log.Warningf("Listen %s was not applied without restarting\n", d5s.Listen)
+		d5s.Listen, d5s.ListenAddr = old.Listen, old.ListenAddr
+	}
+	if d5s.RSAKeys.priv.N.Cmp(old.RSAKeys.priv.N) != 0 {
+		log.Warningln("ServerPrivateKey was not applied without restarting")
+		d5s.RSAKeys = old.RSAKeys
+	}
+	t.mux.configure(d5s.muxSettings())
+	t.d5s = d5s
+	log.Infoln("Server config was reloaded")
+}
+
 func (t *Server) Stats() string {
-	return fmt.Sprintf("Stats/Server ST=%d DT=%d TK=%d",
-		atomic.LoadInt32(&t.stCnt), atomic.LoadInt32(&t.dtCnt), t.sessionMgr.length())
+	return fmt.Sprintf("Stats/Server ST=%d DT=%d TK=%d Saved=%s",
+		atomic.LoadInt32(&t.stCnt), atomic.LoadInt32(&t.dtCnt), t.sessionMgr.length(),
+		i64HumanSize(atomic.LoadInt64(&t.mux.saved)))
 }
@@ -14,6 +14,7 @@ const (
 	CTL_PONG          = byte(2)
 	TOKEN_REQUEST     = byte(5)
 	TOKEN_REPLY       = byte(6)
+	CTL_GOAWAY        = byte(7)
 	CTL_PING_INTERVAL = 120 // time.Second
 	DT_PING_INTERVAL  = 90
 )
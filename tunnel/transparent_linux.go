@@ -0,0 +1,55 @@
+package tunnel
+
+import (
+	"net"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// netfilter: linux/netfilter_ipv4.h
+const SO_ORIGINAL_DST = 80
+
+// take the destination before being redirected by iptables
+func originalDestination(conn net.Conn) (string, error) {
+	tcpConn, y := conn.(*net.TCPConn)
+	if !y {
+		return NULL, TRANSPARENT_UNSUPPORTED
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return NULL, err
+	}
+	var (
+		ip   net.IP
+		port int
+		ipv6 = tcpConn.LocalAddr().(*net.TCPAddr).IP.To4() == nil
+	)
+	e := raw.Control(func(fd uintptr) {
+		if ipv6 {
+			// struct sockaddr_in6 inside
+			var info *syscall.IPv6MTUInfo
+			info, err = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, SO_ORIGINAL_DST)
+			if err == nil {
+				p := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+				port = int(p[0])<<8 | int(p[1])
+				ip = net.IP(info.Addr.Addr[:])
+			}
+		} else {
+			// struct sockaddr_in inside
+			var mreq *syscall.IPv6Mreq
+			mreq, err = syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, SO_ORIGINAL_DST)
+			if err == nil {
+				port = int(mreq.Multiaddr[2])<<8 | int(mreq.Multiaddr[3])
+				ip = net.IPv4(mreq.Multiaddr[4], mreq.Multiaddr[5], mreq.Multiaddr[6], mreq.Multiaddr[7])
+			}
+		}
+	})
+	if e != nil {
+		return NULL, e
+	}
+	if err != nil {
+		return NULL, TRANSPARENT_UNSUPPORTED.Apply(err)
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port)), nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package tunnel
+
+import (
+	"net"
+)
+
+func originalDestination(conn net.Conn) (string, error) {
+	return NULL, TRANSPARENT_UNSUPPORTED
+}
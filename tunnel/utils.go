@@ -14,6 +14,7 @@ import (
 	"github.com/spance/deblocus/exception"
 	log "github.com/spance/deblocus/golang/glog"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"net"
 	"os"
@@ -21,8 +22,10 @@ import (
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -33,6 +36,8 @@ const (
 	USER_CREDENTIAL_TYPE = "deblocus/CLIENT-CREDENTIAL"
 	WORD_d5p             = "D5P"
 	WORD_provider        = "Provider"
+	WORD_proxy           = "Proxy"
+	WORD_weight          = "Weight"
 	SIZE_UNIT            = "BKMG"
 )
 
@@ -46,6 +51,7 @@ var (
 	UNRECOGNIZED_SYMBOLS    = exception.NewW("Unrecognized symbols")
 	UNRECOGNIZED_DIRECTIVES = exception.NewW("Unrecognized directives")
 	LOCAL_BIND_ERROR        = exception.NewW("Local bind error")
+	TRANSPARENT_UNSUPPORTED = exception.NewW("Transparent proxy is unsupported")
 	CONF_MISS               = exception.NewW("Missed config")
 	CONF_ERROR              = exception.NewW("Error config")
 )
@@ -70,6 +76,22 @@ func i64HumanSize(size int64) string {
 	return strconv.FormatInt(size, 10) + string(SIZE_UNIT[i])
 }
 
+// parse 512K, 4M etc. the unit is optional.
+func parseHumanSize(literal string) (int, error) {
+	literal = strings.ToUpper(strings.TrimSpace(literal))
+	var shift uint
+	if n := len(literal); n > 0 {
+		if i := strings.IndexByte(SIZE_UNIT, literal[n-1]); i >= 0 {
+			shift, literal = uint(i)*10, literal[:n-1]
+		}
+	}
+	size, e := strconv.Atoi(literal)
+	if e != nil || size < 0 {
+		return 0, CONF_ERROR.Apply("size " + literal)
+	}
+	return size << shift, nil
+}
+
 func randomRange(min, max int64) (n int64) {
 	for n < min || n >= max {
 		n = rand.Int63n(max)
@@ -97,49 +119,251 @@ func ipAddr(addr net.Addr) string {
 
 // client
 type D5ClientConf struct {
-	Listen     string `importable:":9009"`
+	Listen     string `importable:":9009" list:" " object:"listener"`
 	Verbose    int    `importable:"1"`
-	ListenAddr *net.TCPAddr
+	PACDomains string `importable:"" list:" "`
+	Proxy      string `importable:"" object:"proxy"`
+	QueueLimit string `importable:"4M"`
+	Obfuscate  string `importable:"off"`
+	Priority   string `importable:"" list:";"`
+	Balance    string `importable:"roundrobin"`
+	Affinity   string `importable:"off"`      // off|dest|source sticking to a server
+	Probe      string `importable:""`         // host:port[,seconds] checking the health of servers
+	Backoff    string `importable:"1s,1m,1m"` // base,max[,stable] of reconnecting
+	Listeners  []*Listener
+	Balancer   BalanceStrategy
+	AffinityBy Affinity
 	D5PList    []*D5Params
+	pac        *pacFile
+}
+
+// returns the first problem
+func (c *D5ClientConf) validate() (first error) {
+	c.check(func(_ string, e error) {
+		if first == nil {
+			first = e
+		}
+	})
+	return
 }
 
-func (c *D5ClientConf) validate() error {
+// report the problem of each field, or the field is empty if it's about the
+// whole config.
+func (c *D5ClientConf) check(report func(field string, e error)) {
 	if len(c.D5PList) < 1 {
-		return CONF_MISS.Apply("Not found d5p fragment")
+		report(NULL, CONF_MISS.Apply("Not found d5p fragment"))
+	}
+	var e error
+	if c.Listeners, e = parseListeners(c.Listen); e != nil {
+		report("Listen", e)
+	}
+	if c.Balancer, e = parseBalanceStrategy(c.Balance); e != nil {
+		report("Balance", e)
+	}
+	if c.AffinityBy, e = parseAffinity(c.Affinity); e != nil {
+		report("Affinity", e)
 	}
-	if c.Listen == "" {
-		return LOCAL_BIND_ERROR
+	if c.pac, e = newPACFile(c.PACDomains); e != nil {
+		report("PACDomains", CONF_ERROR.Apply(e))
 	}
-	a, e := net.ResolveTCPAddr("tcp", c.Listen)
+	var queueLimit = EQUEUE_LIMIT // absent in older file
+	if c.QueueLimit != NULL {
+		if queueLimit, e = parseHumanSize(c.QueueLimit); e != nil {
+			report("QueueLimit", e)
+		}
+	}
+	obfs, e := parseObfuscation(c.Obfuscate)
+	if e != nil {
+		report("Obfuscate", e)
+	}
+	priority, e := parsePriorityPolicy(c.Priority)
 	if e != nil {
-		return LOCAL_BIND_ERROR.Apply(e)
+		report("Priority", e)
+	}
+	checkTarget, checkInterval, e := parseProbe(c.Probe)
+	if e != nil {
+		report("Probe", e)
+	}
+	retry, e := parseBackoff(c.Backoff)
+	if e != nil {
+		report("Backoff", e)
+	}
+	for _, d5p := range c.D5PList {
+		d5p.queueLimit = queueLimit
+		d5p.obfs = obfs
+		d5p.priority = priority
+		d5p.checkTarget = checkTarget
+		d5p.checkInterval = checkInterval
+		d5p.backoff = retry
+	}
+	if c.Proxy != NULL {
+		proxy, e := parseUpstreamProxy(c.Proxy)
+		if e != nil {
+			report("Proxy", e)
+		}
+		for _, d5p := range c.D5PList {
+			if d5p.proxy == nil { // not indicated in d5p
+				d5p.proxy = proxy
+			}
+		}
 	}
-	c.ListenAddr = a
-	return nil
 }
 
 // d5p
 type D5Params struct {
 	d5sAddrStr string
-	d5sAddr    *net.TCPAddr
+	endpoints  []*d5Endpoint
+	last       int // index of the last good endpoint
+	lock       sync.Locker
 	provider   string
 	sPub       *rsa.PublicKey
 	algo       string
 	user       string
 	pass       string
+	proxy      *upstreamProxy
+	queueLimit int
+	obfs       *obfuscator
+	priority   priorityPolicy
+	weight     int // in weighted balance
+	// health checking
+	checkTarget   string
+	checkInterval int
+	backoff       *backoffConf
 }
 
+// one of the addresses of server
+type d5Endpoint struct {
+	addr  string
+	host  string
+	port  string
+	addrs string // resolved last time
+}
+
+// try the endpoints in order from the last good one
+func (d *D5Params) dial() (conn *net.TCPConn, err error) {
+	d.lock.Lock()
+	var last = d.last
+	d.lock.Unlock()
+	for i, n := 0, len(d.endpoints); i < n; i++ {
+		var k = (last + i) % n
+		if conn, err = d.dialEndpoint(d.endpoints[k]); err == nil {
+			if k != last {
+				log.Infof("Switch to endpoint %s of %s\n", d.endpoints[k].addr, d.RemoteName())
+				d.lock.Lock()
+				d.last = k
+				d.lock.Unlock()
+			}
+			return
+		}
+		if n > 1 {
+			log.Warningf("Dial endpoint %s error: %s\n", d.endpoints[k].addr, err)
+		}
+	}
+	return
+}
+
+// dial to the server directly or through the upstream proxy
+func (d *D5Params) dialEndpoint(ep *d5Endpoint) (*net.TCPConn, error) {
+	if d.proxy != nil {
+		if log.V(3) {
+			log.Infof("Dial %s via %s\n", ep.addr, d.proxy)
+		}
+		return d.proxy.dial(ep.addr, GENERAL_SO_TIMEOUT)
+	}
+	// re-resolved after the ttl, then try all of the addresses
+	ips, err := defaultResolver.lookup(ep.host)
+	if err != nil {
+		return nil, err
+	}
+	d.resolved(ep, ips)
+	conn, err := happyDial(sortByFamily(ips), ep.port, GENERAL_SO_TIMEOUT, nil)
+	if err != nil {
+		// the server may have moved
+		defaultResolver.forget(ep.host)
+		return nil, err
+	}
+	return conn.(*net.TCPConn), nil
+}
+
+func (d *D5Params) resolved(ep *d5Endpoint, ips []net.IP) {
+	var list = make([]string, len(ips))
+	for i, ip := range ips {
+		list[i] = ip.String()
+	}
+	sort.Strings(list)
+	var addrs = strings.Join(list, ",")
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if addrs != ep.addrs {
+		if ep.addrs != NULL {
+			log.Infof("Address of %s was changed from [%s] to [%s]\n", ep.host, ep.addrs, addrs)
+		}
+		ep.addrs = addrs
+	}
+}
+
+// the stable identity of server, eg. in the hashing of affinity, which
+// will not be changed by appending the endpoints.
 func (d *D5Params) RemoteName() string {
+	var addr = d.d5sAddrStr
+	if len(d.endpoints) > 0 {
+		addr = d.endpoints[0].addr
+	}
+	if d.user != NULL {
+		addr = d.user + "@" + addr
+	}
 	if d.provider != NULL {
-		return d.provider + "@" + d.d5sAddrStr
-	} else {
-		return d.d5sAddrStr
+		return d.provider + "/" + addr
+	}
+	return addr
+}
+
+// the identity of connection, the client should be restarted if it was changed,
+// and the other settings could be reloaded in place.
+func (d *D5Params) Fingerprint() string {
+	var buf = new(bytes.Buffer)
+	// the provider is a part of RemoteName
+	fmt.Fprintf(buf, "%s:%s@%s#%s;%s", d.user, d.pass, d.d5sAddrStr, d.algo, d.provider)
+	if d.sPub != nil {
+		fmt.Fprintf(buf, ";%x", d.sPub.N.Bytes())
+	}
+	if d.proxy != nil {
+		fmt.Fprintf(buf, ";%s:%s@%s", d.proxy.user, d.proxy.pass, d.proxy)
+	}
+	return buf.String()
+}
+
+func (d *D5Params) muxSettings() *muxSettings {
+	return &muxSettings{queueLimit: d.queueLimit, obfs: d.obfs, priority: d.priority}
+}
+
+// host:port,[v6]:port,:alternate-port...
+// the endpoint without host will use the host of previous.
+func parseEndpoints(list string) ([]*d5Endpoint, error) {
+	var endpoints []*d5Endpoint
+	for _, item := range strings.Split(list, ",") {
+		host, port, e := net.SplitHostPort(strings.TrimSpace(item))
+		if e != nil {
+			return nil, INVALID_D5PARAMS.Apply(e)
+		}
+		if host == NULL && len(endpoints) > 0 {
+			host = endpoints[len(endpoints)-1].host
+		}
+		if host == NULL || port == NULL {
+			return nil, INVALID_D5PARAMS.Apply(item)
+		}
+		endpoints = append(endpoints, &d5Endpoint{
+			addr: net.JoinHostPort(host, port),
+			host: host,
+			port: port,
+		})
 	}
+	return endpoints, nil
 }
 
 // without sPub field
 func NewD5Params(uri string) (*D5Params, error) {
-	re := regexp.MustCompile("d5://(\\w+):(\\w+)@([.:\\w]+)#(\\w+)")
+	re := regexp.MustCompile("d5://(\\w+):(\\w+)@([-.:,\\[\\]\\w]+)#(\\w+)")
 	ma := re.FindStringSubmatch(uri)
 	if len(ma) != 5 {
 		return nil, INVALID_D5PARAMS
@@ -148,19 +372,22 @@ func NewD5Params(uri string) (*D5Params, error) {
 	if !y {
 		return nil, UNSUPPORTED_CIPHER.Apply(ma[4])
 	}
-	d5sAddr, e := net.ResolveTCPAddr("tcp", ma[3])
+	endpoints, e := parseEndpoints(ma[3])
 	if e != nil {
-		return nil, D5SER_UNREACHABLE.Apply(e)
+		return nil, e
 	}
 	if log.V(2) {
 		log.Infof("D5Params: %q\n", ma[1:])
 	}
 	return &D5Params{
 		d5sAddrStr: ma[3],
-		d5sAddr:    d5sAddr,
+		endpoints:  endpoints,
+		lock:       new(sync.Mutex),
 		algo:       ma[4],
 		user:       ma[1],
 		pass:       ma[2],
+		queueLimit: EQUEUE_LIMIT,
+		weight:     1,
 	}, nil
 }
 
@@ -182,39 +409,86 @@ type D5ServConf struct {
 	Algo       string `importable:"AES128CFB"`
 	ServerName string `importable:"SERVER_NAME"`
 	Verbose    int    `importable:"1"`
+	Outbound   string `importable:"direct" list:";" object:"outbound"`
+	QueueLimit string `importable:"4M"`
+	MinTunnels int    `importable:"2"`
+	MaxTunnels int    `importable:"8"`
+	Compress   bool   `importable:"false"` // beware of CRIME/BREACH if secrets and attacker data are mixed
+	Obfuscate  string `importable:"off"`
+	DrainWait  int    `importable:"30"` // seconds for streams finishing when shutdown
 	AuthSys    auth.AuthSys
 	RSAKeys    *RSAKeyPair
 	ListenAddr *net.TCPAddr
+	outbound   outboundPolicy
+	queueLimit int
+	obfs       *obfuscator
+}
+
+// returns the first problem
+func (d *D5ServConf) validate() (first error) {
+	d.check(func(_ string, e error) {
+		if first == nil {
+			first = e
+		}
+	})
+	return
 }
 
-func (d *D5ServConf) validate() error {
+// report the problem of each field, or the field is empty if it's about the
+// whole config.
+func (d *D5ServConf) check(report func(field string, e error)) {
+	var e error
 	if len(d.Listen) < 1 {
-		return CONF_MISS.Apply("Listen")
+		report("Listen", CONF_MISS.Apply("Listen"))
+	} else if d.ListenAddr, e = net.ResolveTCPAddr("tcp", d.Listen); e != nil {
+		report("Listen", LOCAL_BIND_ERROR.Apply(e))
 	}
-	a, e := net.ResolveTCPAddr("tcp", d.Listen)
-	if e != nil {
-		return LOCAL_BIND_ERROR.Apply(e)
-	}
-	d.ListenAddr = a
 	if len(d.AuthTable) < 1 {
-		return CONF_MISS.Apply("AuthTable")
+		report("AuthTable", CONF_MISS.Apply("AuthTable"))
+	} else if d.AuthSys, e = auth.GetAuthSysImpl(d.AuthTable); e != nil {
+		report("AuthTable", e)
 	}
-	d.AuthSys, e = auth.GetAuthSysImpl(d.AuthTable)
-	ThrowErr(e)
 	if len(d.Algo) < 1 {
-		return CONF_MISS.Apply("Algo")
-	}
-	_, y := availableCiphers[d.Algo]
-	if !y {
-		return UNSUPPORTED_CIPHER.Apply(d.Algo)
+		report("Algo", CONF_MISS.Apply("Algo"))
+	} else if _, y := availableCiphers[d.Algo]; !y {
+		report("Algo", UNSUPPORTED_CIPHER.Apply(d.Algo))
 	}
 	if d.ServerName == NULL {
-		return CONF_ERROR.Apply("ServerName")
+		report("ServerName", CONF_ERROR.Apply("ServerName"))
 	}
 	if d.RSAKeys == nil {
-		return CONF_MISS.Apply("ServerPrivateKey")
+		report(NULL, CONF_MISS.Apply("ServerPrivateKey"))
+	}
+	if d.outbound, e = parseOutboundPolicy(d.Outbound); e != nil {
+		report("Outbound", e)
+	}
+	d.queueLimit = EQUEUE_LIMIT // absent in older file
+	if d.QueueLimit != NULL {
+		if d.queueLimit, e = parseHumanSize(d.QueueLimit); e != nil {
+			report("QueueLimit", e)
+		}
+	}
+	if d.MinTunnels == 0 {
+		d.MinTunnels = PARALLEL_TUN_QTY
+	}
+	if d.MaxTunnels == 0 {
+		d.MaxTunnels = MAX_TUN_QTY
+	}
+	if d.MinTunnels < 1 || d.MaxTunnels < d.MinTunnels || d.MaxTunnels > 0xff {
+		report("MaxTunnels", CONF_ERROR.Apply("MinTunnels/MaxTunnels"))
+	}
+	if d.obfs, e = parseObfuscation(d.Obfuscate); e != nil {
+		report("Obfuscate", e)
+	}
+	if d.DrainWait == 0 {
+		d.DrainWait = DRAIN_TIMEOUT
+	} else if d.DrainWait < 0 {
+		report("DrainWait", CONF_ERROR.Apply("DrainWait"))
 	}
-	return nil
+}
+
+func (d *D5ServConf) muxSettings() *muxSettings {
+	return &muxSettings{outbound: d.outbound, queueLimit: d.queueLimit, obfs: d.obfs}
 }
 
 // PEMed text
@@ -309,6 +583,14 @@ func parse_d5pFragment(fc []byte) *D5Params {
 	if provider, y := block.Headers[WORD_provider]; y {
 		d5p.provider = provider
 	}
+	if proxy, y := block.Headers[WORD_proxy]; y {
+		d5p.proxy, err = parseUpstreamProxy(proxy)
+		ThrowErr(err)
+	}
+	if weight, y := block.Headers[WORD_weight]; y {
+		d5p.weight, err = strconv.Atoi(weight)
+		ThrowIf(err != nil || d5p.weight < 1, INVALID_D5P_FRAGMENT)
+	}
 	return d5p
 }
 
@@ -320,8 +602,8 @@ func Parse_d5cFile(path string) *D5ClientConf {
 		d5c.D5PList = append(d5c.D5PList, key)
 	}
 	desc := getImportableDesc(d5c)
-	parseD5ConfFile(path, desc, kParse)
-	ThrowErr(d5c.validate())
+	_, origins := parseD5ConfFile(path, desc, kParse)
+	ThrowErr(validateAt(d5c.check, origins))
 	return d5c
 }
 
@@ -350,8 +632,8 @@ func Parse_d5sFile(path string) *D5ServConf {
 		d5s.RSAKeys = key
 	}
 	desc := getImportableDesc(d5s)
-	parseD5ConfFile(path, desc, kParse)
-	ThrowErr(d5s.validate())
+	_, origins := parseD5ConfFile(path, desc, kParse)
+	ThrowErr(validateAt(d5s.check, origins))
 	return d5s
 }
 
@@ -383,17 +665,56 @@ func getImportableDesc(instance interface{}) ImportableFieldDesc {
 	return desc
 }
 
-// interrupt if throw exception
-func parseD5ConfFile(path string, desc ImportableFieldDesc, kParse keyParser) {
-	file, e := os.Open(path)
+// interrupt if throw exception, returns the sources of the fields were set
+// and the env or flag of the overridden.
+func parseD5ConfFile(path string, desc ImportableFieldDesc, kParse keyParser) (sources, origins map[string]string) {
+	data, e := ioutil.ReadFile(path)
 	ThrowErr(e)
-	defer file.Close()
+	var lines = make(map[string]int)
+	sources, origins = make(map[string]string), make(map[string]string)
+	var directive = func(line int, k, v string) {
+		if d, y := desc[k]; y {
+			if prev, y := lines[k]; y {
+				panic(CONF_ERROR.Apply(fmt.Sprintf("%s at line %d was set at line %d", k, line, prev)))
+			}
+			d.set(v)
+			sources[k], lines[k] = SOURCE_FILE, line
+		} else {
+			panic(UNRECOGNIZED_DIRECTIVES.Apply("at line: " + k + " " + v))
+		}
+	}
+	if isJSONConf(path) {
+		parseJSONConf(data, desc, directive, kParse)
+	} else {
+		readD5Conf(bytes.NewReader(data), func(line int, k, v string) {
+			if v == NULL {
+				panic(UNRECOGNIZED_SYMBOLS.Apply(k))
+			}
+			directive(line, k, v)
+		}, func(_ int, block []byte) {
+			kParse(block)
+		})
+	}
+	overrides, e := getOverrides(desc)
+	ThrowErr(e)
+	for _, o := range overrides {
+		o.set(desc[o.field])
+		sources[o.field], origins[o.field] = o.source, o.origin
+	}
+	return
+}
+
+// the text format: "Key Value" lines and the PEM blocks, the value will be
+// empty for the malformed line. the line number is counting from 1.
+func readD5Conf(reader io.Reader, directive func(line int, k, v string), kParse func(line int, block []byte)) {
 	var (
 		buf    = new(bytes.Buffer)
-		r      = bufio.NewReader(file)
+		r      = bufio.NewReader(reader)
 		kB, kE bool
+		n, kL  int
 	)
 	for {
+		n++
 		l, _, e := r.ReadLine()
 		if e != nil {
 			if e == io.EOF {
@@ -406,14 +727,14 @@ func parseD5ConfFile(path string, desc ImportableFieldDesc, kParse keyParser) {
 			if kB {
 				kE = true
 			} else {
-				kB = true
+				kB, kL = true, n
 			}
 		}
 		if kB {
 			buf.Write(l)
 			buf.WriteByte('\n')
 			if kE {
-				kParse(buf.Bytes())
+				kParse(kL, buf.Bytes())
 				kB, kE = false, false
 				buf.Reset()
 			}
@@ -424,31 +745,27 @@ func parseD5ConfFile(path string, desc ImportableFieldDesc, kParse keyParser) {
 			continue
 		}
 		words := strings.Fields(text)
-		if len(words) < 2 {
-			panic(UNRECOGNIZED_SYMBOLS.Apply(words))
-		}
-		k, v := words[0], strings.Join(words[1:], " ")
-		if d, y := desc[k]; y {
-			f := d.fValue
-			switch f.Kind() {
-			case reflect.Bool:
-				vv, e := strconv.ParseBool(v)
-				ThrowErr(e)
-				f.SetBool(vv)
-			case reflect.Int:
-				vv, e := strconv.ParseInt(v, 10, 0)
-				ThrowErr(e)
-				f.SetInt(vv)
-			case reflect.Float32:
-				vv, e := strconv.ParseFloat(v, 32)
-				ThrowErr(e)
-				f.SetFloat(vv)
-			default:
-				f.SetString(v)
-			}
-		} else {
-			panic(UNRECOGNIZED_DIRECTIVES.Apply("at line: " + text))
-		}
+		directive(n, words[0], strings.Join(words[1:], " "))
+	}
+}
+
+func (d *FieldDescriptor) set(v string) {
+	f := d.fValue
+	switch f.Kind() {
+	case reflect.Bool:
+		vv, e := strconv.ParseBool(v)
+		ThrowErr(e)
+		f.SetBool(vv)
+	case reflect.Int:
+		vv, e := strconv.ParseInt(v, 10, 0)
+		ThrowErr(e)
+		f.SetInt(vv)
+	case reflect.Float32:
+		vv, e := strconv.ParseFloat(v, 32)
+		ThrowErr(e)
+		f.SetFloat(vv)
+	default:
+		f.SetString(v)
 	}
 }
 
@@ -474,9 +791,11 @@ func DetectFile(isServ bool) (string, bool) {
 	} else {
 		name = "deblocus.d5c"
 	}
-	for _, f := range []string{filepath.Join(p, name), filepath.Join(homeDir, name), filepath.Join("/etc/deblocus", name)} {
-		if !IsNotExist(f) {
-			return f, true
+	for _, dir := range []string{p, homeDir, "/etc/deblocus"} {
+		for _, f := range []string{filepath.Join(dir, name), filepath.Join(dir, name+JSON_SUFFIX)} {
+			if !IsNotExist(f) {
+				return f, true
+			}
 		}
 	}
 	return filepath.Join(p, name), false
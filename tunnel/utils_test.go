@@ -0,0 +1,70 @@
+package tunnel
+
+import (
+	"testing"
+)
+
+func Test_d5pFingerprint(t *testing.T) {
+	var conf = func(literal string) *D5ClientConf {
+		d5p, e := NewD5Params("d5://u:p@a.example:9008#AES128CFB")
+		if e != nil {
+			t.Fatal(e)
+		}
+		c := &D5ClientConf{Listen: ":9009", Obfuscate: literal, D5PList: []*D5Params{d5p}}
+		if e = c.validate(); e != nil {
+			t.Fatal(e)
+		}
+		return c
+	}
+	var (
+		a = conf("off").D5PList[0]
+		b = conf("off").D5PList[0]
+		c = conf("padding").D5PList[0]
+	)
+	if a.Fingerprint() != b.Fingerprint() {
+		t.Fatalf("the same settings differ\n%s\n%s", a.Fingerprint(), b.Fingerprint())
+	}
+	// reloaded in place
+	b.weight = 2
+	if a.Fingerprint() != c.Fingerprint() || a.Fingerprint() != b.Fingerprint() {
+		t.Fatalf("the tunable settings were identified")
+	}
+	b.user = "v"
+	if a.Fingerprint() == b.Fingerprint() {
+		t.Fatalf("changed user was not identified")
+	}
+}
+
+func Test_matchClients(t *testing.T) {
+	var d5p = func(literal string, weight int) *D5Params {
+		d, e := NewD5Params(literal)
+		if e != nil {
+			t.Fatal(e)
+		}
+		d.weight = weight
+		return d
+	}
+	var (
+		a   = NewClient(d5p("d5://u:p@a.example:9008#AES128CFB", 1), nil)
+		b   = NewClient(d5p("d5://u:p@b.example:9008#AES128CFB", 1), nil)
+		b2  = NewClient(d5p("d5://u:p@b.example:9008#AES128CFB", 1), nil)
+		old = []*Client{a, b, b2}
+	)
+	matched, added, removed := MatchClients(old, []*D5Params{
+		d5p("d5://u:p@c.example:9008#AES128CFB", 1),
+		d5p("d5://u:p@b.example:9008#AES128CFB", 3),
+		d5p("d5://u:p@a.example:9008#AES128CFB", 2),
+	}, nil)
+	if len(matched) != 3 || matched[1] != b || matched[2] != a {
+		t.Fatalf("matched %v", matched)
+	}
+	if len(added) != 1 || added[0] != matched[0] || added[0].nego.RemoteName() != "u@c.example:9008" {
+		t.Fatalf("added %v", added)
+	}
+	if len(removed) != 1 || removed[0] != b2 {
+		t.Fatalf("removed %v", removed)
+	}
+	if a.Weight() != 2 || b.Weight() != 3 || b2.Weight() != 1 {
+		t.Fatalf("weights were not reloaded a=%d b=%d", a.Weight(), b.Weight())
+	}
+}